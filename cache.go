@@ -2,37 +2,49 @@ package hath
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	mrand "math/rand"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	avgFileSize       uint64 = 493 * 1024 // 493kb
-	headerContentType        = "Content-Type"
+	avgFileSize        uint64 = 493 * 1024 // 493kb
+	headerContentType         = "Content-Type"
+	headerCacheControl        = "Cache-Control"
+	headerExpires             = "Expires"
+
+	// DefaultCacheControl is Cache-Control policy for served files,
+	// files are content-addressed and never change, so can be cached forever
+	DefaultCacheControl = "public, max-age=31536000, immutable"
 )
 
 var (
 	// ErrFileNotFound should be returned when file does not exist in frontend
 	ErrFileNotFound = errors.New("File not found in cache")
-	// ErrFileBadLength means that file size does not equals read size
+	// ErrFileBadLength means that file size is not positive, see File.Validate;
+	// data of other length than file size is rejected with ErrSizeMismatch
 	ErrFileBadLength = errors.New("Bad lenght in file")
 
-	// ErrFileInconsistent should be returned if file failed to check sha1 hash
+	// ErrFileInconsistent should be returned if serialized file record is corrupted;
+	// data that failed to check sha1 hash is rejected with ErrHashMismatch
 	ErrFileInconsistent = errors.New("File has bad hash")
 )
 
 var (
 	// FileTypes list for allowerd images
-	FileTypes = []string{"jpg", "png", "gif"}
+	FileTypes = []string{"jpg", "png", "gif", "webp", "avif"}
 	// FileTypesN count of FileTypes
 	FileTypesN = len(FileTypes)
 )
@@ -62,10 +74,14 @@ type Frontend interface {
 // DirectFrontend is frontend that uses DirectCache
 type DirectFrontend struct {
 	cache DirectCache
+	// CacheControl is Cache-Control header value for served files,
+	// DefaultCacheControl if empty. Expires header is set from its max-age
+	// directive for HTTP/1.0 caches, and omitted if there is none.
+	CacheControl string
 }
 
 // Handle request for file
-// returns ErrFileNotFound, ErrFileBadLength
+// returns ErrFileNotFound, ErrSizeMismatch
 // can return unexpected errors
 func (d *DirectFrontend) Handle(file File, w http.ResponseWriter) error {
 	f, err := d.cache.Get(file)
@@ -79,22 +95,48 @@ func (d *DirectFrontend) Handle(file File, w http.ResponseWriter) error {
 	}
 
 	defer f.Close()
-	w.Header().Add(headerContentType, file.ContentType())
+	file.WriteHTTPHeaders(w.Header())
+	cacheControl := d.CacheControl
+	if cacheControl == "" {
+		cacheControl = DefaultCacheControl
+	}
+	w.Header().Set(headerCacheControl, cacheControl)
+	if maxAge, ok := cacheMaxAge(cacheControl); ok {
+		expires := time.Now().Add(maxAge).UTC()
+		w.Header().Set(headerExpires, expires.Format(http.TimeFormat))
+	}
 	n, err := io.Copy(w, f)
 	if n != file.Size {
-		return ErrFileBadLength
+		return ErrSizeMismatch
 	}
 	return err
 }
 
+// cacheMaxAge returns max-age directive of Cache-Control value
+func cacheMaxAge(cacheControl string) (time.Duration, bool) {
+	const prefix = "max-age="
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if len(directive) < len(prefix) || !strings.EqualFold(directive[:len(prefix)], prefix) {
+			continue
+		}
+		seconds, err := strconv.ParseInt(directive[len(prefix):], intBase, 64)
+		if err != nil || seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
 // NewDirectFrontend create direct frontend
 func NewDirectFrontend(cache DirectCache) Frontend {
-	return &DirectFrontend{cache}
+	return &DirectFrontend{cache: cache}
 }
 
 func NewFrontend(dir string) Frontend {
 	cache := &FileCache{dir}
-	return &DirectFrontend{cache}
+	return &DirectFrontend{cache: cache}
 }
 
 // Some boilerplate code to make DirectFrontend implement DirectCache
@@ -130,6 +172,11 @@ func (d *DirectFrontend) Scan(files chan File, progress chan Progress) error {
 	return d.cache.Scan(files, progress)
 }
 
+// Open returns seekable file, see OpenFile
+func (d *DirectFrontend) Open(file File) (ReadSeekCloser, error) {
+	return OpenFile(d.cache, file)
+}
+
 // DirectCache is engine for serving files in hath directly from block devices
 // i.e. not using any redirects
 type DirectCache interface {
@@ -141,6 +188,54 @@ type DirectCache interface {
 	Scan(chan File, chan Progress) error
 }
 
+// ReadSeekCloser is file data that can be read from arbitrary position
+type ReadSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Opener is implemented by caches that can open files for seeking, so
+// e.g. image.DecodeConfig can read only header without reading whole file.
+// Not all caches can seek, e.g. network one can't, so OpenFile should be used
+// to open file from any DirectCache.
+type Opener interface {
+	Open(file File) (ReadSeekCloser, error)
+}
+
+// BatchChecker is implemented by caches that can check existence of many files at once.
+// Files are matched by ContentKey, that is by hash and type, so size and resolution
+// of provided files are ignored and every implementation gives same answer.
+type BatchChecker interface {
+	HasAll(files []File) ([]bool, error)
+}
+
+// bufferedFile is ReadSeekCloser for file data that was read to memory
+type bufferedFile struct {
+	*bytes.Reader
+}
+
+func (bufferedFile) Close() error {
+	return nil
+}
+
+// OpenFile opens file from cache for seeking, using Open if cache implements Opener,
+// otherwise file is read to memory from Get.
+func OpenFile(cache DirectCache, file File) (ReadSeekCloser, error) {
+	if o, ok := cache.(Opener); ok {
+		return o.Open(file)
+	}
+	rc, err := cache.Get(file)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	buf := file.Buffer()
+	if _, err = io.Copy(buf, rc); err != nil {
+		return nil, err
+	}
+	return bufferedFile{bytes.NewReader(buf.Bytes())}, nil
+}
+
 // FileCache serves files from disk
 // no internal buffering, caching or rate limiting is done
 // and should be implement separetaly
@@ -158,6 +253,19 @@ func (c *FileCache) Get(file File) (io.ReadCloser, error) {
 	return f, err
 }
 
+// Open returns underlying os.File, that is seekable,
+// if file does not exist, it will return ErrFileNotFound
+func (c *FileCache) Open(file File) (ReadSeekCloser, error) {
+	f, err := os.Open(c.path(file))
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
 // Remove removes file from storage
 func (c *FileCache) Remove(file File) error {
 	return os.Remove(c.path(file))
@@ -180,6 +288,83 @@ func (c *FileCache) path(file File) string {
 	return path.Join(c.dir, file.Path())
 }
 
+// CacheMetrics is snapshot of cache contents, suitable for JSON
+type CacheMetrics struct {
+	// Files is count of files in cache
+	Files int64 `json:"files"`
+	// Bytes is total size of files in cache
+	Bytes int64 `json:"bytes"`
+}
+
+// Metrics returns count and total size of files in cache.
+// Sizes are taken from file names, so files are listed, but not opened or stat'ed.
+func (c *FileCache) Metrics() (m CacheMetrics, err error) {
+	subdirs, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return m, err
+	}
+	for _, subdir := range subdirs {
+		if !subdir.IsDir() {
+			continue
+		}
+		d, err := os.Open(path.Join(c.dir, subdir.Name()))
+		if err != nil {
+			return m, err
+		}
+		names, err := d.Readdirnames(0)
+		d.Close()
+		if err != nil {
+			return m, err
+		}
+		for _, name := range names {
+			f, err := FileFromID(name)
+			if err != nil {
+				continue
+			}
+			m.Files++
+			m.Bytes += f.Size
+		}
+	}
+	return m, nil
+}
+
+// HasAll returns slice that has true for every file of files that exists in cache, in same order,
+// matching files by ContentKey (see BatchChecker). Every directory is listed once, so files
+// are not stat'ed one by one.
+func (c *FileCache) HasAll(files []File) ([]bool, error) {
+	result := make([]bool, len(files))
+	byDir := make(map[string][]int)
+	for i, f := range files {
+		byDir[f.Dir()] = append(byDir[f.Dir()], i)
+	}
+	for dir, indexes := range byDir {
+		d, err := os.Open(path.Join(c.dir, dir))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		names, err := d.Readdirnames(0)
+		d.Close()
+		if err != nil {
+			return nil, err
+		}
+		exists := make(map[ContentKey]bool, len(names))
+		for _, name := range names {
+			f, err := FileFromNameSep(name, keyStampDelimiter)
+			if err != nil {
+				continue
+			}
+			exists[f.ContentKey()] = true
+		}
+		for _, i := range indexes {
+			result[i] = exists[files[i].ContentKey()]
+		}
+	}
+	return result, nil
+}
+
 // Add saves file to storage
 func (c *FileCache) Add(file File, r io.Reader) error {
 	// creating directory if not exists
@@ -191,38 +376,72 @@ func (c *FileCache) Add(file File, r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	n, err := io.Copy(f, r)
-	if err != nil {
-		return err
+	// checking size and hash while writing
+	err = ValidateContent(io.TeeReader(r, f), file)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
-	// checking real and provided size
-	if n != file.Size {
-		return ErrFileBadLength
+	if err != nil {
+		os.Remove(c.path(file))
 	}
-	return nil
+	return err
 }
 
 // Check performs sha1 hash checking on file
-// returns nil if all ok
+// returns nil if all ok, or ErrSizeMismatch, ErrHashMismatch (see ValidateContent)
 func (c *FileCache) Check(file File) error {
 	f, err := os.Open(c.path(file))
 	if os.IsNotExist(err) {
 		return ErrFileNotFound
 	}
-	hasher := sha1.New()
-	n, err := io.Copy(hasher, f)
 	if err != nil {
 		return err
 	}
-	// checking real and provided size
-	if n != file.Size {
-		return ErrFileBadLength
-	}
-	// checking hashes
-	if !bytes.Equal(file.ByteID(), hasher.Sum(nil)) {
-		return ErrFileInconsistent
+	defer f.Close()
+	return ValidateContent(f, file)
+}
+
+// corruptionBlockSize is size of block that LocateCorruption reads at once
+const corruptionBlockSize = 32 * 1024
+
+// LocateCorruption compares stored and reference streams and returns
+// offset of first differing byte, or -1 if streams are identical.
+// If one stream is a prefix of other, returned offset is length of shorter one.
+func LocateCorruption(stored io.Reader, reference io.Reader) (int64, error) {
+	var (
+		offset int64
+		a      = make([]byte, corruptionBlockSize)
+		b      = make([]byte, corruptionBlockSize)
+	)
+	for {
+		na, errA := io.ReadFull(stored, a)
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return -1, errA
+		}
+		nb, errB := io.ReadFull(reference, b)
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return -1, errB
+		}
+		n := na
+		if nb < n {
+			n = nb
+		}
+		if !bytes.Equal(a[:n], b[:n]) {
+			for i := 0; i < n; i++ {
+				if a[i] != b[i] {
+					return offset + int64(i), nil
+				}
+			}
+		}
+		if na != nb {
+			return offset + int64(n), nil
+		}
+		if errA != nil {
+			// both streams ended
+			return -1, nil
+		}
+		offset += int64(n)
 	}
-	return nil
 }
 
 // Scan storage for files
@@ -283,6 +502,63 @@ func (c *FileCache) Scan(results chan File, progress chan Progress) error {
 	return nil
 }
 
+// IOBudget limits rate of IO operations performed by background tasks,
+// so they don't compete with serving
+type IOBudget struct {
+	// RemovesPerSecond is maximum count of removals per second, zero means no limit
+	RemovesPerSecond int
+}
+
+// interval returns minimum pause between two removals
+func (b IOBudget) interval() time.Duration {
+	if b.RemovesPerSecond <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(b.RemovesPerSecond)
+}
+
+// GC removes from cache all files of inventory that are not static and are outside of ranges
+// or are expired at now with ttl (see File.IsExpired), pacing removals to stay within budget,
+// and returns total size of removed files. Zero or negative ttl disables removal of expired files.
+//
+// GC stops when ctx is done, returning ctx.Err() and size freed so far.
+// Files that are already removed are skipped, so GC can be resumed by calling it again with the same inventory.
+func GC(ctx context.Context, cache DirectCache, inventory []File, ranges StaticRanges, budget IOBudget,
+	now time.Time, ttl time.Duration) (freed int64, err error) {
+	interval := budget.interval()
+	var last time.Time
+	for _, f := range inventory {
+		if f.Static {
+			continue
+		}
+		if ranges.Contains(f) && (ttl <= 0 || !f.IsExpired(now, ttl)) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return freed, err
+		}
+		if wait := interval - time.Now().Sub(last); interval > 0 && wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return freed, ctx.Err()
+			case <-timer.C:
+			}
+		}
+		last = time.Now()
+		err := cache.Remove(f)
+		if os.IsNotExist(err) || err == ErrFileNotFound {
+			continue
+		}
+		if err != nil {
+			return freed, err
+		}
+		freed += f.Size
+	}
+	return freed, nil
+}
+
 // FileGenerator is factory for random files
 type FileGenerator struct {
 	SizeMax       int64
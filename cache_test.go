@@ -1,8 +1,11 @@
 package hath
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"io"
 	"io/ioutil"
 	mrand "math/rand"
 	"net/http"
@@ -10,6 +13,7 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -76,6 +80,31 @@ func TestFileCache(t *testing.T) {
 					err = frontend.Handle(f, rec)
 					So(err, ShouldBeNil)
 					So(rec.Code, ShouldEqual, http.StatusOK)
+					So(rec.Header().Get(headerCacheControl), ShouldEqual, DefaultCacheControl)
+					expires, err := http.ParseTime(rec.Header().Get(headerExpires))
+					So(err, ShouldBeNil)
+					So(expires.After(time.Now()), ShouldBeTrue)
+				})
+				Convey("Custom cache control", func() {
+					f, err := g.New()
+					So(err, ShouldBeNil)
+					frontend := &DirectFrontend{cache: c, CacheControl: "no-cache"}
+					rec := httptest.NewRecorder()
+					So(frontend.Handle(f, rec), ShouldBeNil)
+					So(rec.Header().Get(headerCacheControl), ShouldEqual, "no-cache")
+					So(rec.Header().Get(headerExpires), ShouldBeEmpty)
+				})
+				Convey("Custom max-age", func() {
+					f, err := g.New()
+					So(err, ShouldBeNil)
+					frontend := &DirectFrontend{cache: c, CacheControl: "public, max-age=60"}
+					rec := httptest.NewRecorder()
+					So(frontend.Handle(f, rec), ShouldBeNil)
+					So(rec.Header().Get(headerCacheControl), ShouldEqual, "public, max-age=60")
+					expires, err := http.ParseTime(rec.Header().Get(headerExpires))
+					So(err, ShouldBeNil)
+					So(expires.After(time.Now()), ShouldBeTrue)
+					So(expires.Before(time.Now().Add(2*time.Minute)), ShouldBeTrue)
 				})
 				Convey("Not found", func() {
 					f, err := g.New()
@@ -86,6 +115,7 @@ func TestFileCache(t *testing.T) {
 					err = frontend.Handle(f, rec)
 					So(err, ShouldEqual, ErrFileNotFound)
 					So(rec.Code, ShouldEqual, http.StatusNotFound)
+					So(rec.Header().Get(headerCacheControl), ShouldBeEmpty)
 				})
 				Convey("Bad length", func() {
 					f, err := g.New()
@@ -98,7 +128,7 @@ func TestFileCache(t *testing.T) {
 					frontend := NewDirectFrontend(c)
 					rec := httptest.NewRecorder()
 					err = frontend.Handle(f, rec)
-					So(err, ShouldEqual, ErrFileBadLength)
+					So(err, ShouldEqual, ErrSizeMismatch)
 					So(rec.Code, ShouldEqual, http.StatusOK)
 				})
 			})
@@ -131,7 +161,19 @@ func TestFileCache(t *testing.T) {
 					r, err := os.Open(newpath)
 					So(err, ShouldBeNil)
 					defer r.Close()
-					So(c.Add(f, r), ShouldEqual, ErrFileBadLength)
+					So(c.Add(f, r), ShouldEqual, ErrSizeMismatch)
+					_, err = c.Get(f)
+					So(err, ShouldEqual, ErrFileNotFound)
+				})
+				Convey("Hash inconsistency", func() {
+					r, err := os.Open(newpath)
+					So(err, ShouldBeNil)
+					defer r.Close()
+					bad := f
+					bad.Hash[HashSize-1]++
+					So(c.Add(bad, r), ShouldEqual, ErrHashMismatch)
+					_, err = c.Get(bad)
+					So(err, ShouldEqual, ErrFileNotFound)
 				})
 				Convey("Rewrite", func() {
 					r, err := os.Open(newpath)
@@ -147,7 +189,7 @@ func TestFileCache(t *testing.T) {
 						So(err, ShouldBeNil)
 						w.Write(corruptBytes)
 						w.Close()
-						So(c.Check(f), ShouldEqual, ErrFileBadLength)
+						So(c.Check(f), ShouldEqual, ErrSizeMismatch)
 					})
 					Convey("Hash", func() {
 						// corrupting the file by hash
@@ -159,7 +201,7 @@ func TestFileCache(t *testing.T) {
 						So(err, ShouldBeNil)
 						So(w.Truncate(f.Size), ShouldBeNil)
 						So(w.Close(), ShouldBeNil)
-						So(c.Check(f), ShouldEqual, ErrFileInconsistent)
+						So(c.Check(f), ShouldEqual, ErrHashMismatch)
 					})
 					Convey("Delete", func() {
 						f, err := g.New()
@@ -172,3 +214,248 @@ func TestFileCache(t *testing.T) {
 		})
 	})
 }
+
+func TestGC(t *testing.T) {
+	Convey("GC", t, func() {
+		testDir, err := ioutil.TempDir("", randDirPrefix)
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(testDir)
+		g := FileGenerator{
+			SizeMax:       randFileSizeMax,
+			SizeMin:       randFileSizeMin,
+			ResolutionMax: randFileResolutionMax,
+			ResolutionMin: randFileResolutionMin,
+			Dir:           testDir,
+		}
+		c := &FileCache{testDir}
+		var inventory []File
+		for i := 0; i < 4; i++ {
+			f, err := g.New()
+			So(err, ShouldBeNil)
+			f.Static = false
+			inventory = append(inventory, f)
+		}
+		inventory[0].Static = true
+		ranges := make(StaticRanges)
+		ranges.Add(inventory[1].Range())
+		expected := inventory[2].Size + inventory[3].Size
+		budget := IOBudget{RemovesPerSecond: 100}
+		now := time.Unix(1445167700, 0)
+		for i := range inventory {
+			inventory[i].LastUsage = now.Add(-time.Hour).Unix()
+		}
+
+		Convey("Remove", func() {
+			freed, err := GC(context.Background(), c, inventory, ranges, budget, now, 0)
+			So(err, ShouldBeNil)
+			So(freed, ShouldEqual, expected)
+			So(c.Check(inventory[0]), ShouldBeNil)
+			So(c.Check(inventory[1]), ShouldBeNil)
+			So(c.Check(inventory[2]), ShouldEqual, ErrFileNotFound)
+			So(c.Check(inventory[3]), ShouldEqual, ErrFileNotFound)
+			Convey("Resume", func() {
+				freed, err := GC(context.Background(), c, inventory, ranges, budget, now, 0)
+				So(err, ShouldBeNil)
+				So(freed, ShouldEqual, 0)
+			})
+		})
+		Convey("Expired", func() {
+			freed, err := GC(context.Background(), c, inventory, ranges, budget, now, time.Minute)
+			So(err, ShouldBeNil)
+			So(freed, ShouldEqual, expected+inventory[1].Size)
+			// static files are never expired
+			So(c.Check(inventory[0]), ShouldBeNil)
+			So(c.Check(inventory[1]), ShouldEqual, ErrFileNotFound)
+		})
+		Convey("Not expired in range", func() {
+			freed, err := GC(context.Background(), c, inventory, ranges, budget, now, 2*time.Hour)
+			So(err, ShouldBeNil)
+			So(freed, ShouldEqual, expected)
+			So(c.Check(inventory[1]), ShouldBeNil)
+		})
+		Convey("Cancel", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			freed, err := GC(ctx, c, inventory, ranges, budget, now, 0)
+			So(err, ShouldEqual, context.Canceled)
+			So(freed, ShouldEqual, 0)
+			So(c.Check(inventory[2]), ShouldBeNil)
+		})
+	})
+}
+
+func TestLocateCorruption(t *testing.T) {
+	Convey("Locate corruption", t, func() {
+		reference := make([]byte, corruptionBlockSize*3+100)
+		_, err := rand.Read(reference)
+		So(err, ShouldBeNil)
+		stored := make([]byte, len(reference))
+		copy(stored, reference)
+		locate := func(stored []byte) int64 {
+			offset, err := LocateCorruption(bytes.NewReader(stored), bytes.NewReader(reference))
+			So(err, ShouldBeNil)
+			return offset
+		}
+		Convey("Identical", func() {
+			So(locate(stored), ShouldEqual, -1)
+		})
+		Convey("Header", func() {
+			stored[0]++
+			So(locate(stored), ShouldEqual, 0)
+		})
+		Convey("Block", func() {
+			offset := corruptionBlockSize*2 + 15
+			stored[offset]++
+			stored[offset+10]++
+			So(locate(stored), ShouldEqual, offset)
+		})
+		Convey("Tail", func() {
+			stored[len(stored)-1]++
+			So(locate(stored), ShouldEqual, len(stored)-1)
+		})
+		Convey("Truncated", func() {
+			So(locate(stored[:corruptionBlockSize]), ShouldEqual, corruptionBlockSize)
+			So(locate(stored[:10]), ShouldEqual, 10)
+		})
+		Convey("Longer", func() {
+			So(locate(append(stored, 1, 2, 3)), ShouldEqual, len(reference))
+		})
+	})
+}
+
+// newTestCacheDir returns temporary cache directory, that should be removed
+// by caller, and generator of random files in it
+func newTestCacheDir(t *testing.T) (string, FileGenerator) {
+	testDir, err := ioutil.TempDir("", randDirPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testDir, FileGenerator{
+		SizeMax:       randFileSizeMax,
+		SizeMin:       randFileSizeMin,
+		ResolutionMax: randFileResolutionMax,
+		ResolutionMin: randFileResolutionMin,
+		Dir:           testDir,
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	testDir, g := newTestCacheDir(t)
+	defer os.RemoveAll(testDir)
+	var expected CacheMetrics
+	for i := 0; i < 5; i++ {
+		f, err := g.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected.Files++
+		expected.Bytes += f.Size
+	}
+	Convey("Metrics", t, func() {
+		Convey("File cache", func() {
+			m, err := (&FileCache{testDir}).Metrics()
+			So(err, ShouldBeNil)
+			So(m, ShouldResemble, expected)
+		})
+		Convey("Memory", func() {
+			m := &MemStore{}
+			f, data := memStoreFile(100, 1, false)
+			So(m.Add(f, bytes.NewReader(data)), ShouldBeNil)
+			So(m.Metrics(), ShouldResemble, CacheMetrics{Files: 1, Bytes: 100})
+		})
+	})
+}
+
+func TestOpenFile(t *testing.T) {
+	testDir, g := newTestCacheDir(t)
+	defer os.RemoveAll(testDir)
+	f, err := g.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(testDir, f.Path()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := &MemStore{}
+	if err := mem.Add(f, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	Convey("Open file", t, func() {
+		caches := map[string]DirectCache{
+			"File cache": &FileCache{testDir},
+			"Memory":     mem,
+			// hiding Open, so file is buffered
+			"Buffered": struct{ DirectCache }{mem},
+			"Frontend": NewDirectFrontend(&FileCache{testDir}),
+		}
+		for name, cache := range caches {
+			Convey(name, func() {
+				rsc, err := OpenFile(cache, f)
+				So(err, ShouldBeNil)
+				defer rsc.Close()
+				offset, err := rsc.Seek(-10, io.SeekEnd)
+				So(err, ShouldBeNil)
+				So(offset, ShouldEqual, f.Size-10)
+				tail, err := ioutil.ReadAll(rsc)
+				So(err, ShouldBeNil)
+				So(tail, ShouldResemble, data[f.Size-10:])
+
+				other := f
+				other.Hash[0]++
+				_, err = OpenFile(cache, other)
+				So(err, ShouldEqual, ErrFileNotFound)
+			})
+		}
+	})
+}
+
+func TestHasAll(t *testing.T) {
+	testDir, g := newTestCacheDir(t)
+	defer os.RemoveAll(testDir)
+	var (
+		files    []File
+		expected []bool
+		mem      = &MemStore{}
+	)
+	for i := 0; i < 20; i++ {
+		f, err := g.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path.Join(testDir, f.Path()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mem.Add(f, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		missing := g.NewFake()
+		// only hash and type identify file
+		resized := f
+		resized.Size++
+		resized.Width++
+		retyped := f
+		retyped.Type = (f.Type + 1) % UnknownImage
+		files = append(files, f, missing, resized, retyped)
+		expected = append(expected, true, false, true, false)
+	}
+	Convey("Has all", t, func() {
+		for name, checker := range map[string]BatchChecker{
+			"File cache": &FileCache{testDir},
+			"Memory":     mem,
+		} {
+			checker := checker
+			Convey(name, func() {
+				result, err := checker.HasAll(files)
+				So(err, ShouldBeNil)
+				So(result, ShouldResemble, expected)
+			})
+		}
+		Convey("Empty", func() {
+			result, err := (&FileCache{testDir}).HasAll(nil)
+			So(err, ShouldBeNil)
+			So(result, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,93 @@
+package hath
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// challengeLength is maximum count of bytes requested in Challenge
+	challengeLength = 64
+	// challengeNonceSize is size of random nonce in Challenge
+	challengeNonceSize = 16
+)
+
+// ErrChallengeFailed is returned by VerifyAnswer if answer does not match challenge
+var ErrChallengeFailed = errors.New("hath => storage challenge failed")
+
+// Challenge asks peer to prove that it stores file by returning
+// Length bytes of file data at Offset, hashed with Nonce
+type Challenge struct {
+	File   File
+	Offset int64
+	Length int64
+	Nonce  [challengeNonceSize]byte
+}
+
+// Answer is response to Challenge
+type Answer struct {
+	Data   []byte
+	Digest [sha1.Size]byte
+}
+
+// StorageChallenge returns challenge for random slice of file data with random nonce
+func StorageChallenge(f File) Challenge {
+	c := Challenge{File: f, Length: challengeLength}
+	if f.Size < c.Length {
+		c.Length = f.Size
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	if span := f.Size - c.Length + 1; span > 0 {
+		c.Offset = int64(binary.LittleEndian.Uint64(b[:]) % uint64(span))
+	}
+	if _, err := rand.Read(c.Nonce[:]); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// challengeDigest returns sha1 of data and nonce
+func challengeDigest(data []byte, c Challenge) [sha1.Size]byte {
+	h := sha1.New()
+	h.Write(data)
+	h.Write(c.Nonce[:])
+	var d [sha1.Size]byte
+	copy(d[:], h.Sum(nil))
+	return d
+}
+
+// AnswerChallenge reads requested slice of file from data and returns answer for c
+func AnswerChallenge(data io.ReaderAt, c Challenge) (Answer, error) {
+	a := Answer{Data: make([]byte, c.Length)}
+	n, err := data.ReadAt(a.Data, c.Offset)
+	if int64(n) < c.Length {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return a, err
+	}
+	a.Digest = challengeDigest(a.Data, c)
+	return a, nil
+}
+
+// VerifyAnswer checks answer against reference data of file in constant time,
+// returning ErrChallengeFailed on mismatch
+func VerifyAnswer(reference io.ReaderAt, c Challenge, a Answer) error {
+	expected, err := AnswerChallenge(reference, c)
+	if err != nil {
+		return err
+	}
+	dataOK := subtle.ConstantTimeCompare(expected.Data, a.Data)
+	digestOK := subtle.ConstantTimeCompare(expected.Digest[:], a.Digest[:])
+	if dataOK&digestOK != 1 {
+		return ErrChallengeFailed
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package hath
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"io"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStorageChallenge(t *testing.T) {
+	Convey("Storage challenge", t, func() {
+		data := make([]byte, 1000)
+		rand.Read(data)
+		f := File{Size: int64(len(data)), Hash: sha1.Sum(data), Type: JPG}
+		c := StorageChallenge(f)
+		So(c.Length, ShouldEqual, challengeLength)
+		So(c.Offset+c.Length, ShouldBeLessThan, f.Size+1)
+		So(c.Nonce, ShouldNotEqual, StorageChallenge(f).Nonce)
+
+		a, err := AnswerChallenge(bytes.NewReader(data), c)
+		So(err, ShouldBeNil)
+		So(a.Data, ShouldResemble, data[c.Offset:c.Offset+c.Length])
+		So(VerifyAnswer(bytes.NewReader(data), c, a), ShouldBeNil)
+
+		Convey("Wrong data", func() {
+			corrupted := make([]byte, len(data))
+			copy(corrupted, data)
+			corrupted[c.Offset] ^= 0xFF
+			a, err := AnswerChallenge(bytes.NewReader(corrupted), c)
+			So(err, ShouldBeNil)
+			So(VerifyAnswer(bytes.NewReader(data), c, a), ShouldEqual, ErrChallengeFailed)
+		})
+		Convey("Replayed answer", func() {
+			other := c
+			other.Nonce[0]++
+			So(VerifyAnswer(bytes.NewReader(data), other, a), ShouldEqual, ErrChallengeFailed)
+		})
+		Convey("Short data", func() {
+			_, err := AnswerChallenge(bytes.NewReader(data[:c.Offset+1]), c)
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+		})
+		Convey("Small file", func() {
+			small := File{Size: 10}
+			c := StorageChallenge(small)
+			So(c.Length, ShouldEqual, 10)
+			So(c.Offset, ShouldEqual, 0)
+		})
+	})
+}
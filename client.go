@@ -3,10 +3,12 @@ package hath
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -88,6 +90,8 @@ var (
 	ErrTimeDesync = errors.New("Time on server and on client differ too much")
 	// ErrClientVersionOld api outdated
 	ErrClientVersionOld = errors.New("Client version is too old")
+	// ErrQuorumNotReached not enough sources returned file with expected hash
+	ErrQuorumNotReached = errors.New("Not enough sources agree on file hash")
 )
 
 // APIResponse represents response from rpc api
@@ -371,20 +375,8 @@ func (v Vars) GetUint64(k string) (uint64, error) {
 }
 
 // GetStaticRange parses static range list
-func (v Vars) GetStaticRange(k string) (s StaticRanges, err error) {
-	elems := strings.Split(v.Get(k), staticRangeDelimiter)
-	s = make(StaticRanges)
-	for _, elem := range elems {
-		if len(elem) == 0 {
-			continue
-		}
-		r, err := ParseStaticRange(elem)
-		if err != nil {
-			return s, err
-		}
-		s.Add(r)
-	}
-	return s, err
+func (v Vars) GetStaticRange(k string) (StaticRanges, error) {
+	return ParseStaticRanges(v.Get(k))
 }
 
 // GetProxyMode parses ProxyMode
@@ -553,6 +545,65 @@ func (c Client) GetFile(u *url.URL) (rc io.ReadCloser, err error) {
 	return res.Body, nil
 }
 
+// fetchVerified downloads file from source and returns its data
+// if it has size and sha1 hash of f
+func (c Client) fetchVerified(ctx context.Context, f File, source string) ([]byte, error) {
+	req, err := http.NewRequest(httpGET, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, ErrUnexpected{Err: errors.New("Unexpected status")}
+	}
+	buf := f.Buffer()
+	if err := ValidateContent(io.TeeReader(res.Body, buf), f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FetchVerifiedQuorum downloads file from sources one by one until quorum
+// of them return data with expected size and sha1 hash, skipping failed sources.
+// Returns ErrQuorumNotReached if sources are exhausted, or ctx error if it is done.
+//
+// Every file is fully downloaded at least quorum times and held in memory,
+// so bandwidth cost is quorum times higher than for single source download.
+func (c Client) FetchVerifiedQuorum(ctx context.Context, f File, sources []string, quorum int) (io.ReadCloser, error) {
+	if quorum < 1 {
+		quorum = 1
+	}
+	var (
+		agreed int
+		result []byte
+	)
+	for _, source := range sources {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := c.fetchVerified(ctx, f, source)
+		if err != nil {
+			log.Println("client:", "source", source, "failed verification:", err)
+			continue
+		}
+		agreed++
+		if result == nil {
+			result = data
+		}
+		if agreed >= quorum {
+			return ioutil.NopCloser(bytes.NewReader(result)), nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrQuorumNotReached
+}
+
 // RemoveFiles notifies api server of removed files
 func (c Client) RemoveFiles(files []File) error {
 	count := len(files)
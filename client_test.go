@@ -2,10 +2,13 @@ package hath
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"testing"
 	"time"
@@ -265,3 +268,44 @@ func TestClientRequest(t *testing.T) {
 		})
 	})
 }
+
+func TestClientFetchVerifiedQuorum(t *testing.T) {
+	data := []byte("quorum test file data")
+	f := File{Size: int64(len(data)), Type: JPG}
+	f.Hash = sha1.Sum(data)
+	serve := func(body []byte, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write(body)
+		}))
+	}
+	good := serve(data, http.StatusOK)
+	defer good.Close()
+	bad := serve(append([]byte("X"), data[1:]...), http.StatusOK)
+	defer bad.Close()
+	failed := serve(nil, http.StatusNotFound)
+	defer failed.Close()
+
+	c := NewClient(ClientConfig{})
+	c.httpClient = http.DefaultClient
+	Convey("Quorum", t, func() {
+		Convey("Reached", func() {
+			rc, err := c.FetchVerifiedQuorum(context.Background(), f, []string{bad.URL, good.URL, failed.URL, good.URL}, 2)
+			So(err, ShouldBeNil)
+			defer rc.Close()
+			body, err := ioutil.ReadAll(rc)
+			So(err, ShouldBeNil)
+			So(body, ShouldResemble, data)
+		})
+		Convey("Not reached", func() {
+			_, err := c.FetchVerifiedQuorum(context.Background(), f, []string{good.URL, bad.URL, failed.URL}, 2)
+			So(err, ShouldEqual, ErrQuorumNotReached)
+		})
+		Convey("Canceled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := c.FetchVerifiedQuorum(ctx, f, []string{good.URL}, 1)
+			So(err, ShouldEqual, context.Canceled)
+		})
+	})
+}
@@ -0,0 +1,152 @@
+package hath
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// ErrCompactCorrupted is returned by UnmarshalCompact on malformed data
+var ErrCompactCorrupted = errors.New("hath => compact batch is corrupted")
+
+// MarshalCompact serializes files to compact batch format, that is for transport only,
+// e.g. for syncing file lists over network, and should not be used for storage, as
+// it is not fixed-size like File.Bytes.
+//
+// Files are sorted by hash, and every hash is stored as length of common prefix with
+// previous hash and remaining bytes, while all numbers are varint-encoded:
+//
+//	| count | prefix | suffix | type | static | size | width | height | last usage | ...
+//
+// Order of files in batch is order of CompareFiles, files slice is not modified.
+func MarshalCompact(files []File) []byte {
+	sorted := make([]File, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool {
+		return CompareFiles(sorted[i], sorted[j]) < 0
+	})
+
+	var (
+		buf  [binary.MaxVarintLen64]byte
+		prev [HashSize]byte
+	)
+	b := make([]byte, 0, binary.MaxVarintLen64+len(files)*(HashSize/2+8))
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(len(sorted)))]...)
+	for _, f := range sorted {
+		prefix := 0
+		for prefix < HashSize && f.Hash[prefix] == prev[prefix] {
+			prefix++
+		}
+		b = append(b, byte(prefix))
+		b = append(b, f.Hash[prefix:]...)
+		b = append(b, byte(f.Type))
+		if f.Static {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+		b = append(b, buf[:binary.PutUvarint(buf[:], uint64(f.Size))]...)
+		b = append(b, buf[:binary.PutUvarint(buf[:], uint64(f.Width))]...)
+		b = append(b, buf[:binary.PutUvarint(buf[:], uint64(f.Height))]...)
+		b = append(b, buf[:binary.PutVarint(buf[:], f.LastUsage)]...)
+		prev = f.Hash
+	}
+	return b
+}
+
+// compactReader reads compact batch, remembering first error
+type compactReader struct {
+	b   []byte
+	err error
+}
+
+func (r *compactReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) == 0 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *compactReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = io.ErrUnexpectedEOF
+		if n < 0 {
+			r.err = ErrCompactCorrupted
+		}
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *compactReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = io.ErrUnexpectedEOF
+		if n < 0 {
+			r.err = ErrCompactCorrupted
+		}
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// UnmarshalCompact deserializes files from batch produced by MarshalCompact,
+// returning io.ErrUnexpectedEOF for truncated and ErrCompactCorrupted for malformed batch.
+func UnmarshalCompact(b []byte) ([]File, error) {
+	r := &compactReader{b: b}
+	count := r.uvarint()
+	if r.err != nil {
+		return nil, r.err
+	}
+	// every file takes at least 7 bytes, so count can't be bigger
+	if count > uint64(len(r.b)/7) {
+		return nil, ErrCompactCorrupted
+	}
+	var prev [HashSize]byte
+	files := make([]File, count)
+	for i := range files {
+		f := &files[i]
+		prefix := int(r.byte())
+		if prefix > HashSize {
+			return nil, ErrCompactCorrupted
+		}
+		if r.err == nil && len(r.b) < HashSize-prefix {
+			r.err = io.ErrUnexpectedEOF
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		copy(f.Hash[:prefix], prev[:prefix])
+		r.b = r.b[copy(f.Hash[prefix:], r.b):]
+		f.Type = FileType(r.byte())
+		f.Static = r.byte() != 0
+		f.Size = int64(r.uvarint())
+		f.Width = int(r.uvarint())
+		f.Height = int(r.uvarint())
+		f.LastUsage = r.varint()
+		if r.err != nil {
+			return nil, r.err
+		}
+		prev = f.Hash
+	}
+	if len(r.b) != 0 {
+		return nil, ErrCompactCorrupted
+	}
+	return files, nil
+}
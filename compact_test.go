@@ -0,0 +1,72 @@
+package hath
+
+import (
+	"io"
+	"sort"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCompact(t *testing.T) {
+	Convey("Compact", t, func() {
+		g := FileGenerator{
+			SizeMax:       10 * 1024 * 1024,
+			SizeMin:       1024,
+			ResolutionMax: 4000,
+			ResolutionMin: 100,
+			TimeDelta:     3600,
+		}
+		files := make([]File, 10000)
+		for i := range files {
+			files[i] = g.NewFake()
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return CompareFiles(files[i], files[j]) < 0
+		})
+		b := MarshalCompact(files)
+		So(len(b), ShouldBeLessThan, len(files)*FileBytes)
+		parsed, err := UnmarshalCompact(b)
+		So(err, ShouldBeNil)
+		So(parsed, ShouldResemble, files)
+
+		Convey("Unsorted", func() {
+			unsorted := []File{files[2], files[0], files[1]}
+			parsed, err := UnmarshalCompact(MarshalCompact(unsorted))
+			So(err, ShouldBeNil)
+			So(parsed, ShouldResemble, files[:3])
+			So(unsorted[0], ShouldResemble, files[2])
+		})
+		Convey("Empty", func() {
+			parsed, err := UnmarshalCompact(MarshalCompact(nil))
+			So(err, ShouldBeNil)
+			So(parsed, ShouldBeEmpty)
+		})
+		Convey("Error handling", func() {
+			_, err := UnmarshalCompact(nil)
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			_, err = UnmarshalCompact(b[:len(b)-1])
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			_, err = UnmarshalCompact(append(b, 0))
+			So(err, ShouldEqual, ErrCompactCorrupted)
+			_, err = UnmarshalCompact([]byte{100, 0})
+			So(err, ShouldEqual, ErrCompactCorrupted)
+			small := MarshalCompact(files[:1])
+			small[1] = HashSize + 1
+			_, err = UnmarshalCompact(small)
+			So(err, ShouldEqual, ErrCompactCorrupted)
+		})
+	})
+}
+
+func BenchmarkMarshalCompact(b *testing.B) {
+	g := FileGenerator{SizeMax: 10 * 1024 * 1024, ResolutionMax: 4000}
+	files := make([]File, 1000)
+	for i := range files {
+		files[i] = g.NewFake()
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		MarshalCompact(files)
+	}
+}
@@ -0,0 +1,105 @@
+package hath
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// ErrCSVHeader is returned by ReadFilesCSV if header row is not filesCSVHeader
+var ErrCSVHeader = errors.New("hath => bad csv header")
+
+// filesCSVHeader is header row of WriteFilesCSV output
+var filesCSVHeader = []string{"hash", "type", "size", "width", "height", "static", "last_usage"}
+
+// WriteFilesCSV writes files as RFC 4180 CSV with header row, one row per file
+// with hex hash, type name, decimal numbers and static as true or false, so it
+// can be loaded into spreadsheet or database, e.g. with COPY ... CSV HEADER.
+func WriteFilesCSV(w io.Writer, files []File) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(filesCSVHeader); err != nil {
+		return err
+	}
+	row := make([]string, len(filesCSVHeader))
+	for _, f := range files {
+		row[0] = f.HexID()
+		row[1] = f.Type.String()
+		row[2] = strconv.FormatInt(f.Size, intBase)
+		row[3] = strconv.Itoa(f.Width)
+		row[4] = strconv.Itoa(f.Height)
+		row[5] = strconv.FormatBool(f.Static)
+		row[6] = strconv.FormatInt(f.LastUsage, intBase)
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadFilesCSV reads files written by WriteFilesCSV. Returns ErrCSVHeader if header
+// row does not match, or *csv.ParseError with line and column of invalid field,
+// wrapping error of its parsing, e.g. ErrFileTypeUnknown for unknown type.
+func ReadFilesCSV(r io.Reader) ([]File, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(filesCSVHeader)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, ErrCSVHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range filesCSVHeader {
+		if header[i] != name {
+			return nil, ErrCSVHeader
+		}
+	}
+	var files []File
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, err
+		}
+		var f File
+		field, err := parseFileCSV(row, &f)
+		if err != nil {
+			line, column := cr.FieldPos(field)
+			return files, &csv.ParseError{StartLine: line, Line: line, Column: column, Err: err}
+		}
+		files = append(files, f)
+	}
+}
+
+// parseFileCSV parses row of WriteFilesCSV output into f,
+// returning index of invalid field and error of its parsing
+func parseFileCSV(row []string, f *File) (int, error) {
+	var err error
+	for field, s := range row {
+		switch field {
+		case 0:
+			err = f.SetHash(s)
+		case 1:
+			f.Type, err = ParseFileTypeStrict(s)
+		case 2:
+			f.Size, err = strconv.ParseInt(s, intBase, 64)
+		case 3:
+			f.Width, err = strconv.Atoi(s)
+		case 4:
+			f.Height, err = strconv.Atoi(s)
+		case 5:
+			f.Static, err = strconv.ParseBool(s)
+		case 6:
+			f.LastUsage, err = strconv.ParseInt(s, intBase, 64)
+		}
+		if err != nil {
+			return field, err
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,68 @@
+package hath
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFilesCSV(t *testing.T) {
+	Convey("Files CSV", t, func() {
+		var files []File
+		for _, id := range []string{
+			"070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png",
+			"a1b2c3d4e5f60718293a4b5c6d7e8f9012345678-999-640-480-jpg",
+			"ffffffffffffffffffffffffffffffffffffffff-1-1-1-gif",
+		} {
+			f, err := FileFromID(id)
+			So(err, ShouldBeNil)
+			files = append(files, f)
+		}
+		files[0].Static = true
+		files[0].LastUsage = 1474117323
+		files[1].LastUsage = 0
+		files[2].LastUsage = 1445167700
+
+		golden, err := ioutil.ReadFile("test/files.csv")
+		So(err, ShouldBeNil)
+		var out bytes.Buffer
+		So(WriteFilesCSV(&out, files), ShouldBeNil)
+		So(out.String(), ShouldEqual, string(golden))
+
+		parsed, err := ReadFilesCSV(bytes.NewReader(golden))
+		So(err, ShouldBeNil)
+		So(parsed, ShouldResemble, files)
+		Convey("Empty", func() {
+			var out bytes.Buffer
+			So(WriteFilesCSV(&out, nil), ShouldBeNil)
+			So(out.String(), ShouldEqual, "hash,type,size,width,height,static,last_usage\n")
+			parsed, err := ReadFilesCSV(&out)
+			So(err, ShouldBeNil)
+			So(parsed, ShouldBeEmpty)
+		})
+		Convey("Error handling", func() {
+			_, err := ReadFilesCSV(strings.NewReader(""))
+			So(err, ShouldEqual, ErrCSVHeader)
+			_, err = ReadFilesCSV(strings.NewReader("hash,kind,size,width,height,static,last_usage\n"))
+			So(err, ShouldEqual, ErrCSVHeader)
+
+			bad := strings.Replace(string(golden), ",gif,", ",bmp,", 1)
+			parsed, err := ReadFilesCSV(strings.NewReader(bad))
+			So(parsed, ShouldHaveLength, 2)
+			var parseErr *csv.ParseError
+			So(errors.As(err, &parseErr), ShouldBeTrue)
+			So(parseErr.Line, ShouldEqual, 4)
+			So(parseErr.Column, ShouldEqual, 42)
+			So(errors.Is(err, ErrFileTypeUnknown), ShouldBeTrue)
+
+			_, err = ReadFilesCSV(strings.NewReader(string(golden) + "a,b\n"))
+			So(errors.As(err, &parseErr), ShouldBeTrue)
+			So(parseErr.Err, ShouldEqual, csv.ErrFieldCount)
+		})
+	})
+}
@@ -0,0 +1,77 @@
+package hath
+
+import (
+	"math/rand"
+)
+
+const (
+	// staticRangesCount is total count of possible static ranges
+	staticRangesCount = 1 << (8 * staticRangeBytes)
+	// distributionResolutionMax is maximum width and height of generated files
+	distributionResolutionMax = 3000
+)
+
+// Distribution describes how generated files are spread across static ranges
+type Distribution interface {
+	// Sampler returns function that returns next range using r as source
+	Sampler(r *rand.Rand) func() StaticRange
+}
+
+// UniformDistribution spreads files evenly across all ranges
+type UniformDistribution struct{}
+
+// Sampler implements Distribution
+func (UniformDistribution) Sampler(r *rand.Rand) func() StaticRange {
+	return func() StaticRange {
+		return rangeFromIndex(r.Intn(staticRangesCount))
+	}
+}
+
+// ZipfDistribution makes few ranges hot and most cold, following Zipf's law
+// with parameters S > 1 and V >= 1 (see rand.NewZipf), 1.1 and 1 if zero.
+// Hot ranges are scattered across range space instead of being adjacent.
+type ZipfDistribution struct {
+	S float64
+	V float64
+}
+
+// Sampler implements Distribution
+func (d ZipfDistribution) Sampler(r *rand.Rand) func() StaticRange {
+	s, v := d.S, d.V
+	if s == 0 {
+		s = 1.1
+	}
+	if v == 0 {
+		v = 1
+	}
+	z := rand.NewZipf(r, s, v, staticRangesCount-1)
+	return func() StaticRange {
+		// multiplication by odd number is bijection modulo power of two,
+		// so every rank maps to unique range
+		return rangeFromIndex(int(z.Uint64() * 40503 % staticRangesCount))
+	}
+}
+
+func rangeFromIndex(i int) (s StaticRange) {
+	s[0] = byte(i >> 8)
+	s[1] = byte(i)
+	return s
+}
+
+// GenerateWithDistribution returns n fake files with ranges following distribution d.
+// Output depends only on r, so same seed gives same files.
+func GenerateWithDistribution(n int, d Distribution, r *rand.Rand) []File {
+	next := d.Sampler(r)
+	files := make([]File, n)
+	for i := range files {
+		f := &files[i]
+		r.Read(f.Hash[:])
+		staticRange := next()
+		copy(f.Hash[:staticRangeBytes], staticRange[:])
+		f.Type = FileType(r.Intn(int(UnknownImage)))
+		f.Size = r.Int63n(int64(avgFileSize)*2) + 1
+		f.Width = r.Intn(distributionResolutionMax) + 1
+		f.Height = r.Intn(distributionResolutionMax) + 1
+	}
+	return files
+}
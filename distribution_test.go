@@ -0,0 +1,43 @@
+package hath
+
+import (
+	"math/rand"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// hottestRange returns count of files in most populated range
+func hottestRange(files []File) int {
+	counts := make(map[StaticRange]int)
+	max := 0
+	for _, f := range files {
+		counts[f.Range()]++
+		if counts[f.Range()] > max {
+			max = counts[f.Range()]
+		}
+	}
+	return max
+}
+
+func TestGenerateWithDistribution(t *testing.T) {
+	Convey("Distribution", t, func() {
+		const n = 10000
+		Convey("Deterministic", func() {
+			a := GenerateWithDistribution(n, ZipfDistribution{}, rand.New(rand.NewSource(42)))
+			b := GenerateWithDistribution(n, ZipfDistribution{}, rand.New(rand.NewSource(42)))
+			So(a, ShouldResemble, b)
+			So(a, ShouldHaveLength, n)
+			for _, f := range a[:100] {
+				So(f.Type, ShouldBeLessThan, UnknownImage)
+				So(f.Size, ShouldBeGreaterThan, 0)
+			}
+		})
+		Convey("Skew", func() {
+			uniform := GenerateWithDistribution(n, UniformDistribution{}, rand.New(rand.NewSource(1)))
+			zipf := GenerateWithDistribution(n, ZipfDistribution{}, rand.New(rand.NewSource(1)))
+			So(hottestRange(uniform), ShouldBeLessThan, 10)
+			So(hottestRange(zipf), ShouldBeGreaterThan, n/10)
+		})
+	})
+}
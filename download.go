@@ -0,0 +1,58 @@
+package hath
+
+import (
+	"fmt"
+	"sync"
+)
+
+// downloadCall is in-flight or completed DownloadGroup.Do call
+type downloadCall struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+// DownloadGroup deduplicates concurrent downloads of same file, so
+// when several requests miss on file at once, it is fetched only once.
+// Files are identified by ContentKey. Zero value is ready to use.
+type DownloadGroup struct {
+	mu    sync.Mutex
+	calls map[ContentKey]*downloadCall
+}
+
+// Do calls fetch for file f, if there is no fetch for same file in flight,
+// otherwise waits for in-flight fetch to complete. All callers receive same error,
+// so fetch should write file to store and callers should read it from there on success.
+// Once call is completed, next Do for same file calls fetch again.
+// If fetch panics, waiting callers receive ErrUnexpected and panic is propagated.
+func (g *DownloadGroup) Do(f File, fetch func() error) error {
+	key := f.ContentKey()
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[ContentKey]*downloadCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.err
+	}
+	c := new(downloadCall)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		r := recover()
+		if r != nil {
+			c.err = ErrUnexpected{Err: fmt.Errorf("download panic: %v", r)}
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+		if r != nil {
+			panic(r)
+		}
+	}()
+	c.err = fetch()
+	return c.err
+}
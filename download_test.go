@@ -0,0 +1,112 @@
+package hath
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// downloadWaiters returns count of goroutines waiting
+// in DownloadGroup.Do for in-flight fetch to complete
+func downloadWaiters() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	waiters := 0
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(stack, "(*WaitGroup).Wait") && strings.Contains(stack, "(*DownloadGroup).Do") {
+			waiters++
+		}
+	}
+	return waiters
+}
+
+func TestDownloadGroup(t *testing.T) {
+	Convey("Download group", t, func() {
+		var g DownloadGroup
+		f := File{Hash: [HashSize]byte{1, 2, 3}, Type: JPG, Size: 100}
+		Convey("Concurrent", func() {
+			var (
+				fetches int32
+				wg      sync.WaitGroup
+				started = make(chan struct{})
+				release = make(chan struct{})
+				errFail = errors.New("fetch failed")
+				errs    = make([]error, 10)
+			)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[0] = g.Do(f, func() error {
+					atomic.AddInt32(&fetches, 1)
+					close(started)
+					<-release
+					return errFail
+				})
+			}()
+			<-started
+			for i := 1; i < len(errs); i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = g.Do(f, func() error {
+						atomic.AddInt32(&fetches, 1)
+						return nil
+					})
+				}(i)
+			}
+			// waiting for all callers to join in-flight fetch, deadline
+			// is reached only if they don't, failing on fetches check
+			deadline := time.Now().Add(5 * time.Second)
+			for downloadWaiters() < len(errs)-1 && time.Now().Before(deadline) {
+				runtime.Gosched()
+			}
+			close(release)
+			wg.Wait()
+			So(atomic.LoadInt32(&fetches), ShouldEqual, 1)
+			for _, err := range errs {
+				So(err, ShouldEqual, errFail)
+			}
+			So(g.calls, ShouldBeEmpty)
+		})
+		Convey("Panic", func() {
+			var c *downloadCall
+			So(func() {
+				g.Do(f, func() error {
+					g.mu.Lock()
+					c = g.calls[f.ContentKey()]
+					g.mu.Unlock()
+					panic("fetch panic")
+				})
+			}, ShouldPanic)
+			So(IsUnexpected(c.err), ShouldBeTrue)
+			So(g.calls, ShouldBeEmpty)
+			So(g.Do(f, func() error { return nil }), ShouldBeNil)
+		})
+		Convey("Sequential", func() {
+			fetches := 0
+			fetch := func() error {
+				fetches++
+				return nil
+			}
+			So(g.Do(f, fetch), ShouldBeNil)
+			So(g.Do(f, fetch), ShouldBeNil)
+			other := f
+			other.Hash[0] = 2
+			So(g.Do(other, fetch), ShouldBeNil)
+			So(fetches, ShouldEqual, 3)
+		})
+	})
+}
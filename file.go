@@ -2,18 +2,27 @@ package hath
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log"
 	"math/big"
+	"math/bits"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/dineshappavoo/basex"
 )
@@ -22,11 +31,20 @@ const (
 	keyStampEnd  = "hotlinkthis"
 	prefixLenght = 2
 	// HashSize is length of sha1 hash in bytes
-	HashSize             = 20
-	sizeBytes            = 4
-	resolutionBytes      = 2
-	fileBytes            = 38
+	HashSize        = 20
+	sizeBytes       = 4
+	resolutionBytes = 2
+	usageBytes      = 5
+	usageBytesV1    = 8
+	// FileBytes is size of serialized File (see File.Bytes), not size of File in memory
+	FileBytes = 35
+	// FileBytesV1 is size of serialized File in previous layout with 8 byte LastUsage,
+	// that is still accepted by FileFromBytes
+	FileBytesV1          = FileBytes - usageBytes + usageBytesV1
 	keyStampLength       = 10
+	keyStampMinLength    = 8                  // 32 bits, see KeyStamper
+	keyStampMaxLength    = sha1.Size * 2      // whole hex digest
+	keyStampURLBytes     = keyStampLength / 2 // same 40 bits as in hex KeyStamp
 	staticRangeBytes     = 2
 	staticRangeHexLength = 4
 	staticRangeDelimiter = ";"
@@ -40,29 +58,91 @@ const (
 // FileType represents file format of image
 type FileType byte
 
-// StaticRange is prefix for static ranges assigned to user
+// StaticRange is prefix for static ranges assigned to user. Every 2 byte prefix
+// is valid range, so any StaticRange value is valid, and String of it is parsed
+// back by ParseStaticRange.
 type StaticRange [staticRangeBytes]byte
 
 func (s StaticRange) String() string {
 	return hex.EncodeToString(s[:])
 }
 
-// ParseStaticRange parses hex string static range start
+var (
+	// ErrInvalidStaticRange matches all errors of static range parsing with errors.Is
+	ErrInvalidStaticRange = errors.New("hath => invalid static range")
+	// ErrStaticRangeLength when static range is not 4 hex chars
+	ErrStaticRangeLength = errors.New("hath => static range should be 4 hex chars")
+	// ErrStaticRangeHex when static range has non-hex chars
+	ErrStaticRangeHex = errors.New("hath => static range has non-hex chars")
+)
+
+// ParseStaticRange parses hex string static range start, that is 4 hex chars.
+// Returns StaticRangeError with ErrStaticRangeLength or ErrStaticRangeHex.
 func ParseStaticRange(s string) (r StaticRange, err error) {
 	if len(s) != staticRangeHexLength {
-		return r, io.ErrUnexpectedEOF
+		return r, StaticRangeError{Range: s, Err: ErrStaticRangeLength}
 	}
-	b, err := hex.DecodeString(s)
-	if err != nil {
-		return r, err
+	if _, err = hex.Decode(r[:], []byte(s)); err != nil {
+		return StaticRange{}, StaticRangeError{Range: s, Err: ErrStaticRangeHex}
+	}
+	return r, nil
+}
+
+// Filter returns files that are in static range, preserving order
+func (s StaticRange) Filter(files []File) []File {
+	var result []File
+	for _, f := range files {
+		if f.InRange(s) {
+			result = append(result, f)
+		}
 	}
-	copy(r[:], b[:])
-	return r, err
+	return result
 }
 
-// StaticRanges contain ranges
+// StaticRanges contain ranges. StaticRanges is not safe for modification concurrent
+// with reads, use SyncStaticRanges or swap Clone snapshots instead.
 type StaticRanges map[StaticRange]bool
 
+// StaticRangeError is returned by ParseStaticRange and ParseStaticRanges
+// and names range that failed to parse
+type StaticRangeError struct {
+	Range string
+	Err   error
+}
+
+func (e StaticRangeError) Error() string {
+	return fmt.Sprintf("hath => bad static range %q: %v", e.Range, e.Err)
+}
+
+// Unwrap returns underlying error
+func (e StaticRangeError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true for ErrInvalidStaticRange, so all parsing errors can be checked at once
+func (e StaticRangeError) Is(target error) bool {
+	return target == ErrInvalidStaticRange
+}
+
+// ParseStaticRanges parses static ranges from string in format of StaticRanges.String,
+// that is hex ranges separated by staticRangeDelimiter, skipping empty ones.
+// Returns StaticRangeError for first range that failed to parse.
+func ParseStaticRanges(s string) (StaticRanges, error) {
+	ranges := make(StaticRanges)
+	for _, elem := range strings.Split(s, staticRangeDelimiter) {
+		elem = strings.TrimSpace(elem)
+		if len(elem) == 0 {
+			continue
+		}
+		r, err := ParseStaticRange(elem)
+		if err != nil {
+			return nil, err
+		}
+		ranges.Add(r)
+	}
+	return ranges, nil
+}
+
 // Contains returns true if file f is in static ranges
 func (s StaticRanges) Contains(f File) bool {
 	return s[f.Range()]
@@ -83,6 +163,66 @@ func (s StaticRanges) Count() int {
 	return len(s)
 }
 
+// Clone returns independent copy of static ranges, that can be
+// modified or passed to other goroutine without affecting s
+func (s StaticRanges) Clone() StaticRanges {
+	c := make(StaticRanges, len(s))
+	for r, ok := range s {
+		c[r] = ok
+	}
+	return c
+}
+
+// Partition buckets files by their static ranges, preserving order in every bucket.
+// Files that are not in any of ranges are returned in outside.
+func (s StaticRanges) Partition(files []File) (buckets map[StaticRange][]File, outside []File) {
+	buckets = make(map[StaticRange][]File)
+	for _, f := range files {
+		r := f.Range()
+		if !s[r] {
+			outside = append(outside, f)
+			continue
+		}
+		buckets[r] = append(buckets[r], f)
+	}
+	return buckets, outside
+}
+
+// Diff returns ranges that are only in other as added and ranges that are
+// only in s as removed, so equal ranges result in empty added and removed.
+// Neither s nor other is modified.
+func (s StaticRanges) Diff(other StaticRanges) (added, removed StaticRanges) {
+	added = make(StaticRanges)
+	removed = make(StaticRanges)
+	for r := range other {
+		if !s[r] {
+			added.Add(r)
+		}
+	}
+	for r := range s {
+		if !other[r] {
+			removed.Add(r)
+		}
+	}
+	return added, removed
+}
+
+// Intersect returns ranges that are both in s and other.
+// Neither s nor other is modified.
+func (s StaticRanges) Intersect(other StaticRanges) StaticRanges {
+	small, large := s, other
+	if len(small) > len(large) {
+		small, large = large, small
+	}
+	result := make(StaticRanges)
+	for r := range small {
+		if large[r] {
+			result.Add(r)
+		}
+	}
+	return result
+}
+
 func (s StaticRanges) String() string {
 	var elems []string
 	for k := range s {
@@ -92,6 +232,100 @@ func (s StaticRanges) String() string {
 	return strings.Join(elems, staticRangeDelimiter)
 }
 
+// MarshalJSON implements json.Marshaler, encoding ranges as sorted array of hex strings
+func (s StaticRanges) MarshalJSON() ([]byte, error) {
+	elems := make([]string, 0, len(s))
+	for k := range s {
+		elems = append(elems, k.String())
+	}
+	sort.Strings(elems)
+	return json.Marshal(elems)
+}
+
+// UnmarshalJSON implements json.Unmarshaler for JSON produced by MarshalJSON,
+// null or empty array result in empty ranges. Returns StaticRangeError for
+// first range that failed to parse.
+func (s *StaticRanges) UnmarshalJSON(b []byte) error {
+	var elems []string
+	if err := json.Unmarshal(b, &elems); err != nil {
+		return err
+	}
+	ranges := make(StaticRanges, len(elems))
+	for _, elem := range elems {
+		r, err := ParseStaticRange(elem)
+		if err != nil {
+			return err
+		}
+		ranges.Add(r)
+	}
+	*s = ranges
+	return nil
+}
+
+// SyncStaticRanges is StaticRanges that is safe for concurrent use, so ranges can be
+// reassigned while files are served. Zero value is empty ranges.
+type SyncStaticRanges struct {
+	mu     sync.RWMutex
+	ranges StaticRanges
+}
+
+// NewSyncStaticRanges returns SyncStaticRanges with copy of ranges
+func NewSyncStaticRanges(ranges StaticRanges) *SyncStaticRanges {
+	return &SyncStaticRanges{ranges: ranges.Clone()}
+}
+
+// Contains returns true if file f is in static ranges
+func (s *SyncStaticRanges) Contains(f File) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ranges.Contains(f)
+}
+
+// Add static range
+func (s *SyncStaticRanges) Add(r StaticRange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ranges == nil {
+		s.ranges = make(StaticRanges)
+	}
+	s.ranges.Add(r)
+}
+
+// Remove static range
+func (s *SyncStaticRanges) Remove(r StaticRange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ranges.Remove(r)
+}
+
+// Count of static ranges
+func (s *SyncStaticRanges) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ranges.Count()
+}
+
+func (s *SyncStaticRanges) String() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ranges.String()
+}
+
+// Set replaces all static ranges with copy of ranges
+func (s *SyncStaticRanges) Set(ranges StaticRanges) {
+	c := ranges.Clone()
+	s.mu.Lock()
+	s.ranges = c
+	s.mu.Unlock()
+}
+
+// Snapshot returns copy of current static ranges
+func (s *SyncStaticRanges) Snapshot() StaticRanges {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ranges.Clone()
+}
+
 func (f FileType) String() string {
 	if f == JPG {
 		return "jpg"
@@ -102,6 +336,15 @@ func (f FileType) String() string {
 	if f == GIF {
 		return "gif"
 	}
+	if f == WEBP {
+		return "webp"
+	}
+	if f == AVIF {
+		return "avif"
+	}
+	if format, ok := lookupFormat(f); ok {
+		return format.name
+	}
 	return "tmp"
 }
 
@@ -112,43 +355,256 @@ const (
 	PNG
 	// GIF animation
 	GIF
-	// UnknownImage is not supported format
+	// WEBP image
+	WEBP
+	// AVIF image
+	AVIF
+	// UnknownImage is not supported format.
+	// New types are added before it, so values of other types are never shifted,
+	// while UnknownImage itself should not be persisted.
 	UnknownImage
 )
 
 var (
-	// ContentTypes is map of file types to content types
+	// ContentTypes is map of file types to content types. It is extended by RegisterFormat,
+	// so it should be read directly only after formats are registered during initialization;
+	// File.ContentType and File.ContentTypeAs are safe for concurrent use with RegisterFormat.
 	ContentTypes = map[FileType]string{
 		JPG:          "image/jpeg",
 		PNG:          "image/png",
 		GIF:          "image/gif",
+		WEBP:         "image/webp",
+		AVIF:         "image/avif",
 		UnknownImage: "application/octet-stream",
 	}
 )
 
+// fileFormat describes image format that can be detected by magic bytes
+type fileFormat struct {
+	fileType    FileType
+	name        string
+	magic       []byte
+	contentType string
+	// magic bytes in [anyFrom, anyTo) match any byte, e.g. size of container
+	anyFrom, anyTo int
+}
+
+// matches returns true if header starts with magic of format
+func (f fileFormat) matches(header []byte) bool {
+	if len(header) < len(f.magic) {
+		return false
+	}
+	for i, b := range f.magic {
+		if header[i] != b && !f.any(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// collides returns true if magic of one format is prefix of another, so formats
+// can't be told apart. Bytes that match any byte in one of formats are skipped,
+// but at least one byte should be fixed in both, e.g. size of container does
+// not collide with magic of other format.
+func (f fileFormat) collides(other fileFormat) bool {
+	fixed := false
+	for i := 0; i < len(f.magic) && i < len(other.magic); i++ {
+		if f.any(i) || other.any(i) {
+			continue
+		}
+		if f.magic[i] != other.magic[i] {
+			return false
+		}
+		fixed = true
+	}
+	return fixed
+}
+
+func (f fileFormat) any(i int) bool {
+	return i >= f.anyFrom && i < f.anyTo
+}
+
+const (
+	// registered formats are allocated from the upper half of FileType values,
+	// so they never clash with the built-in ones
+	registeredFileTypeStart FileType = 128
+	registeredFileTypeMax   FileType = 255
+)
+
+var (
+	formatsLock sync.RWMutex
+	formats     = []fileFormat{
+		{JPG, "jpg", []byte{0xFF, 0xD8, 0xFF}, "image/jpeg", 0, 0},
+		{PNG, "png", []byte{0x89, 'P', 'N', 'G'}, "image/png", 0, 0},
+		{GIF, "gif", []byte("GIF8"), "image/gif", 0, 0},
+		// WEBP and AVIF are containers, so their magic is not at start of file:
+		// "RIFF", 4 bytes of size, "WEBP" and 4 bytes of box size, "ftypavif" (or "ftypavis")
+		{WEBP, "webp", []byte("RIFF\x00\x00\x00\x00WEBP"), "image/webp", 4, 8},
+		{AVIF, "avif", []byte("\x00\x00\x00\x00ftypavif"), "image/avif", 0, 4},
+		{AVIF, "avif", []byte("\x00\x00\x00\x00ftypavis"), "image/avif", 0, 4},
+	}
+	nextFileType = registeredFileTypeStart
+)
+
+// RegisterFormat allocates new FileType for format with provided name, magic prefix and
+// content type, and wires it into detection, ParseFileType and ContentTypes.
+// It is intended to be called during initialization.
+//
+// Registered types are not part of the stable wire enum: values are allocated in registration
+// order and can differ between builds, so they should not be persisted or sent to other nodes.
+//
+// RegisterFormat panics if name is already used or magic is a prefix of (or prefixed by)
+// magic of another format, because such formats can't be told apart.
+func RegisterFormat(name string, magic []byte, contentType string) FileType {
+	name = strings.ToLower(name)
+	if len(magic) == 0 {
+		panic("hath: RegisterFormat with empty magic for " + name)
+	}
+	if builtinFileType(name) != UnknownImage {
+		panic("hath: RegisterFormat called for built-in " + name)
+	}
+	m := make([]byte, len(magic))
+	copy(m, magic)
+	registered := fileFormat{name: name, magic: m, contentType: contentType}
+	formatsLock.Lock()
+	defer formatsLock.Unlock()
+	for _, format := range formats {
+		if format.name == name {
+			panic("hath: RegisterFormat called twice for " + name)
+		}
+		if format.collides(registered) {
+			panic("hath: RegisterFormat magic of " + name + " collides with " + format.name)
+		}
+	}
+	if nextFileType > registeredFileTypeMax || nextFileType < registeredFileTypeStart {
+		panic("hath: RegisterFormat has no more file types for " + name)
+	}
+	registered.fileType = nextFileType
+	nextFileType++
+	formats = append(formats, registered)
+	ContentTypes[registered.fileType] = contentType
+	return registered.fileType
+}
+
+// lookupFormat returns format of registered file type
+func lookupFormat(t FileType) (fileFormat, bool) {
+	if t < registeredFileTypeStart {
+		return fileFormat{}, false
+	}
+	formatsLock.RLock()
+	defer formatsLock.RUnlock()
+	for _, format := range formats {
+		if format.fileType == t {
+			return format, true
+		}
+	}
+	return fileFormat{}, false
+}
+
+// detectFileType returns FileType by magic bytes in header of file
+// or UnknownImage if format is not known
+func detectFileType(header []byte) FileType {
+	formatsLock.RLock()
+	defer formatsLock.RUnlock()
+	for _, format := range formats {
+		if format.matches(header) {
+			return format.fileType
+		}
+	}
+	return UnknownImage
+}
+
+// fileTypeHeaderSize is count of bytes that DetectFileType reads, enough
+// for all built-in formats, including containers
+const fileTypeHeaderSize = 16
+
+// DetectFileType reads header of file from r and returns FileType by its magic bytes
+// or UnknownImage if format is not known. Only fileTypeHeaderSize bytes are read,
+// so rest of data can be read from r after detection.
+func DetectFileType(r io.Reader) (FileType, error) {
+	var header [fileTypeHeaderSize]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return UnknownImage, err
+	}
+	return detectFileType(header[:n]), nil
+}
+
+// VerifyType detects type of file data from r (see DetectFileType) and
+// returns ErrFileTypeMismatch if it is not f.Type
+func (f File) VerifyType(r io.Reader) error {
+	t, err := DetectFileType(r)
+	if err != nil {
+		return err
+	}
+	if t != f.Type {
+		return ErrFileTypeMismatch
+	}
+	return nil
+}
+
 var (
 	// ErrFileTypeUnknown when FileType is UnknownImage
 	ErrFileTypeUnknown = errors.New("hath => file type unknown")
 	// ErrHashBadLength when hash size is not HashSize
 	ErrHashBadLength = errors.New("hath => hash of image has bad length")
+	// ErrHashEmpty when hash is not set
+	ErrHashEmpty = errors.New("hath => hash of image is empty")
+	// ErrUnsafePath when path is not canonical file path, e.g. has traversal
+	ErrUnsafePath = errors.New("hath => unsafe file path")
+	// ErrInvalidFileID when file id has wrong count of fields, and matches
+	// all errors of FileFromIDStrict with errors.Is
+	ErrInvalidFileID = errors.New("hath => invalid file id")
+	// ErrBadSeparator when separator of file id can be confused with its fields
+	ErrBadSeparator = errors.New("hath => bad file id separator")
+	// ErrBadResolution when width or height does not fit in resolutionBytes
+	ErrBadResolution = errors.New("hath => resolution out of range")
 )
 
-// ParseFileType returns FileType from string
-func ParseFileType(t string) FileType {
-	switch strings.ToLower(t) {
+// builtinFileType returns built-in FileType for lowercase name or UnknownImage
+func builtinFileType(name string) FileType {
+	switch name {
 	case "jpg", "jpeg":
 		return JPG
 	case "png":
 		return PNG
 	case "gif":
 		return GIF
-	default:
-		return UnknownImage
+	case "webp":
+		return WEBP
+	case "avif":
+		return AVIF
+	}
+	return UnknownImage
+}
+
+// ParseFileType returns FileType from string
+func ParseFileType(t string) FileType {
+	if f := builtinFileType(strings.ToLower(t)); f != UnknownImage {
+		return f
+	}
+	formatsLock.RLock()
+	defer formatsLock.RUnlock()
+	for _, format := range formats {
+		if format.fileType >= registeredFileTypeStart && format.name == strings.ToLower(t) {
+			return format.fileType
+		}
+	}
+	return UnknownImage
+}
+
+// ParseFileTypeStrict is ParseFileType that returns ErrFileTypeUnknown if t is not name
+// of known type, so empty or unsupported type can be rejected instead of using UnknownImage
+func ParseFileTypeStrict(t string) (FileType, error) {
+	f := ParseFileType(t)
+	if f == UnknownImage {
+		return f, ErrFileTypeUnknown
 	}
+	return f, nil
 }
 
 // File is hath file representation
-// total 20 + 4 + 2 + 2 + 1 + 8 + 1 = 38 bytes
+// total 20 + 4 + 2 + 2 + 1 + 5 + 1 = 35 bytes
 // in memory = 56 bytes
 type File struct {
 	Hash [HashSize]byte `json:"hash"` // 20 byte
@@ -159,7 +615,7 @@ type File struct {
 	Width  int   `json:"width"`  // 2 byte
 	Height int   `json:"height"` // 2 byte
 	// LastUsage is Unix timestamp
-	LastUsage int64 `json:"last_usage"` // 8 byte (can be optimized)
+	LastUsage int64 `json:"last_usage"` // 5 byte
 }
 
 // ContentType of image
@@ -171,9 +627,23 @@ func (f File) ContentType() string {
 		return "image/png"
 	case GIF:
 		return "image/gif"
-	default:
-		return "application/octet-stream"
+	case WEBP:
+		return "image/webp"
+	case AVIF:
+		return "image/avif"
+	}
+	if format, ok := lookupFormat(f.Type); ok {
+		return format.contentType
 	}
+	return "application/octet-stream"
+}
+
+// ContentTypeAs returns content type of file transcoded to type t, e.g. when
+// file is served in other format than stored. File itself is not changed,
+// and ContentType still reports stored type.
+func (f File) ContentTypeAs(t FileType) string {
+	f.Type = t
+	return f.ContentType()
 }
 
 // Range returns static range of file
@@ -187,9 +657,32 @@ func (f File) InRange(r StaticRange) bool {
 	return bytes.Equal(r[:], f.Hash[:staticRangeBytes])
 }
 
-// Bytes serializes file info into byte array
+// FileSerializedSize returns length of slice returned by File.Bytes and
+// expected by FileFromBytes, that is FileBytes.
+func FileSerializedSize() int {
+	return FileBytes
+}
+
+// maxLastUsage is maximum LastUsage that can be serialized, that is in year 36812
+const maxLastUsage = 1<<(8*usageBytes) - 1
+
+// Bytes serializes file info into byte array of FileBytes length.
+// Only lowest 4 bytes of Size are serialized, so higher bytes of larger sizes
+// are dropped, and sizes above FileMaximumSize are rejected by FileFromBytes.
+// Same way only lowest 5 bytes of LastUsage are serialized, so it should be
+// from 0 to maxLastUsage.
 func (f File) Bytes() []byte {
-	var result [fileBytes]byte
+	return f.AppendBytes(make([]byte, 0, FileBytes))
+}
+
+// AppendBytes appends serialized file info (see File.Bytes) to dst and returns
+// extended slice, so scratch buffer can be reused to serialize many files without
+// allocations. Buffer is grown by append only if dst has less than FileBytes spare
+// capacity, so appending many files to one slice is amortized.
+func (f File) AppendBytes(dst []byte) []byte {
+	start := len(dst)
+	dst = append(dst, make([]byte, FileBytes)...)
+	result := dst[start:]
 	var buff [8]byte
 	cursor := 0
 
@@ -204,14 +697,14 @@ func (f File) Bytes() []byte {
 	// writing static
 	if f.Static {
 		result[cursor] = 255
+	} else {
+		result[cursor] = 0
 	}
 	cursor++
 
-	// Size is 64bit, or 8 byte
-	// little endian is 1111111111000000000
-	// we want only first right 4 byte
-	binary.LittleEndian.PutUint64(buff[:], uint64(f.Size))
-	copy(result[cursor:cursor+sizeBytes], buff[:sizeBytes])
+	// Size is 64bit, but only lowest 4 byte are stored,
+	// higher bytes are dropped
+	binary.LittleEndian.PutUint32(result[cursor:cursor+sizeBytes], uint32(f.Size))
 	cursor += sizeBytes
 
 	// writing height
@@ -224,11 +717,10 @@ func (f File) Bytes() []byte {
 	copy(result[cursor:cursor+resolutionBytes], buff[:resolutionBytes])
 	cursor += resolutionBytes
 
-	// writing time
+	// writing time, only lowest 5 bytes
 	binary.LittleEndian.PutUint64(buff[:], uint64(f.LastUsage))
-	copy(result[cursor:cursor+8], buff[:])
-	cursor += 8
-	return result[:]
+	copy(result[cursor:cursor+usageBytes], buff[:usageBytes])
+	return dst
 }
 
 // FileFromBytes deserializes byte slice into file
@@ -236,12 +728,16 @@ func FileFromBytes(result []byte) (f File, err error) {
 	return f, FileFromBytesTo(result, &f)
 }
 
-// FileFromBytesTo deserializes byte slice into file by pointer
+// FileFromBytesTo deserializes byte slice into file by pointer.
+// Both current layout of FileBytes length and previous one of FileBytesV1 length
+// are accepted, layout is detected by length, so records in old layout can be
+// migrated by deserializing them and serializing again with File.Bytes.
+// Returns ErrFileInconsistent if slice has bad length, or ErrSizeOverflow if
+// size is greater than FileMaximumSize, e.g. on corrupted record.
 func FileFromBytesTo(result []byte, f *File) error {
-	if len(result) != fileBytes {
+	if len(result) != FileBytes && len(result) != FileBytesV1 {
 		return ErrFileInconsistent
 	}
-	var buff [8]byte
 	cursor := 0
 	// reading hash
 	copy(f.Hash[:], result[cursor:HashSize])
@@ -255,28 +751,28 @@ func FileFromBytesTo(result []byte, f *File) error {
 	f.Static = result[cursor] == 255
 	cursor++
 
-	// Size is 64bit, or 8 byte
-	// little endian is 1111111111000000000
-	// we want only first right 4 byte
-	copy(buff[:sizeBytes], result[cursor:cursor+sizeBytes])
-	f.Size = int64(binary.LittleEndian.Uint64(buff[:]))
+	// Size is 64bit, but only lowest 4 byte are stored
+	f.Size = int64(binary.LittleEndian.Uint32(result[cursor : cursor+sizeBytes]))
+	if f.Size > FileMaximumSize {
+		return ErrSizeOverflow
+	}
 	cursor += sizeBytes
 
 	// reading height
-	buff = [8]byte{} // buffer reset
-	copy(buff[:resolutionBytes], result[cursor:cursor+resolutionBytes])
-	f.Height = int(binary.LittleEndian.Uint64(buff[:]))
+	f.Height = int(binary.LittleEndian.Uint16(result[cursor : cursor+resolutionBytes]))
 	cursor += resolutionBytes
 
 	// reading width
-	buff = [8]byte{} // buffer reset
-	copy(buff[:resolutionBytes], result[cursor:cursor+resolutionBytes])
-	f.Width = int(binary.LittleEndian.Uint64(buff[:]))
+	f.Width = int(binary.LittleEndian.Uint16(result[cursor : cursor+resolutionBytes]))
 	cursor += resolutionBytes
 
-	// reading time
-	buff = [8]byte{} // buffer reset
-	copy(buff[:], result[cursor:cursor+8])
+	// reading time, 5 bytes in current layout or 8 bytes in previous one
+	if len(result) == FileBytesV1 {
+		f.LastUsage = int64(binary.LittleEndian.Uint64(result[cursor : cursor+usageBytesV1]))
+		return nil
+	}
+	var buff [8]byte
+	copy(buff[:], result[cursor:cursor+usageBytes])
 	f.LastUsage = int64(binary.LittleEndian.Uint64(buff[:]))
 
 	return nil
@@ -292,19 +788,168 @@ func (f File) indexKey() []byte {
 	return bytes.Join(elems, nil)
 }
 
-// LastUsageBefore returns true, if last usage occured before deadline t
+// LastUsageUTC returns LastUsage as time in UTC
+func (f File) LastUsageUTC() time.Time {
+	return time.Unix(f.LastUsage, 0).UTC()
+}
+
+// LastUsageBefore returns true, if last usage occured strictly before deadline t,
+// that is file was not used since t and is candidate for eviction.
+// Deadline is compared as unix time, so location of t does not matter:
+// local time and its UTC equivalent give same result.
 func (f File) LastUsageBefore(t time.Time) bool {
-	return t.Unix() < f.LastUsage
+	return f.LastUsage < t.Unix()
+}
+
+// Age returns time passed since last usage of file, see AgeAt
+func (f File) Age() time.Duration {
+	return f.AgeAt(time.Now())
+}
+
+// AgeAt returns time passed from last usage of file to now. Age is negative
+// if last usage is after now, and zero LastUsage gives age since Unix epoch.
+func (f File) AgeAt(now time.Time) time.Duration {
+	return now.Sub(f.LastUsageUTC())
+}
+
+// IsExpired returns true if file is not static and was last used more than ttl before now.
+// Static files are never expired.
+func (f File) IsExpired(now time.Time, ttl time.Duration) bool {
+	if f.Static {
+		return false
+	}
+	return f.AgeAt(now) > ttl
+}
+
+// FileLayout is layout of cache directory, where files are sharded in nested directories
+// by prefix of hex hash. Every level of Depth takes next PrefixLength chars of hash,
+// so layout with Depth 2 and PrefixLength 2 has 65536 directories, and file with hash
+// "070b45..." is placed at "07/0b/070b45...". Prefix is limited by length of hex hash.
+type FileLayout struct {
+	Depth        int
+	PrefixLength int
 }
 
-// Dir is first prefixLenght chars of file hash
+// DefaultFileLayout is single level of 256 directories, used by File.Dir and File.Path
+var DefaultFileLayout = FileLayout{Depth: 1, PrefixLength: prefixLenght}
+
+// Dir returns relative directory of file, that is empty if Depth or PrefixLength is not positive
+func (l FileLayout) Dir(f File) string {
+	if l.Depth <= 0 || l.PrefixLength <= 0 {
+		return ""
+	}
+	id := f.HexID()
+	elems := make([]string, 0, l.Depth)
+	for i := 0; i < l.Depth && (i+1)*l.PrefixLength <= len(id); i++ {
+		elems = append(elems, id[i*l.PrefixLength:(i+1)*l.PrefixLength])
+	}
+	return path.Join(elems...)
+}
+
+// Path returns relative path to file in layout
+func (l FileLayout) Path(f File) string {
+	return path.Join(l.Dir(f), f.String())
+}
+
+// Dir is first prefixLenght chars of file hash, see DefaultFileLayout
 func (f File) Dir() string {
-	return f.HexID()[:prefixLenght]
+	return DefaultFileLayout.Dir(f)
+}
+
+// DirErr is Dir that returns error instead of invalid directory
+// if file hash is not set or its hex representation is too short for prefix
+func (f File) DirErr() (string, error) {
+	if f.Hash == [HashSize]byte{} {
+		return "", ErrHashEmpty
+	}
+	id := f.HexID()
+	if len(id) < prefixLenght {
+		return "", ErrHashBadLength
+	}
+	return id[:prefixLenght], nil
+}
+
+// ShardIndex returns numeric 0-255 shard of file, that is Dir parsed as hex
+func (f File) ShardIndex() int {
+	return int(f.Hash[0])
 }
 
-// Path returns relative path to file
+// Path returns relative path to file in DefaultFileLayout
 func (f File) Path() string {
-	return path.Join(f.Dir(), f.String())
+	return DefaultFileLayout.Path(f)
+}
+
+// safeTypeNameLength is maximum length of type name in SafePath
+const safeTypeNameLength = 16
+
+// SafePath is Path that is safe for any filesystem. Name contains only
+// lowercase hex hash, decimal numbers, delimiters and type name restricted
+// to [a-z0-9_] and safeTypeNameLength, so total length is bounded.
+// Hash is always lowercase, so two files can't collide on case-insensitive
+// filesystems. For built-in types SafePath equals Path.
+func (f File) SafePath() string {
+	typeName := []byte(strings.ToLower(f.Type.String()))
+	if len(typeName) > safeTypeNameLength {
+		typeName = typeName[:safeTypeNameLength]
+	}
+	for i, c := range typeName {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			typeName[i] = '_'
+		}
+	}
+	elems := []string{
+		f.HexID(),
+		sInt64(f.Size),
+		strconv.Itoa(f.Width),
+		strconv.Itoa(f.Height),
+		string(typeName),
+	}
+	return path.Join(f.Dir(), strings.Join(elems, keyStampDelimiter))
+}
+
+// ErrFileMisplaced is matched by FileDirError, returned for file in wrong directory
+var ErrFileMisplaced = errors.New("hath => file is in wrong directory")
+
+// FileDirError is returned by FileFromPath if directory of file does not match
+// prefix of its hash, e.g. if file was moved to wrong shard by hand or by broken
+// migration. It matches both ErrFileMisplaced and ErrUnsafePath with errors.Is.
+type FileDirError struct {
+	File     File
+	Dir      string
+	Expected string
+}
+
+func (e FileDirError) Error() string {
+	return fmt.Sprintf("hath => file %s is in directory %q instead of %q", e.File.HexID(), e.Dir, e.Expected)
+}
+
+// Is returns true for ErrFileMisplaced and ErrUnsafePath
+func (e FileDirError) Is(target error) bool {
+	return target == ErrFileMisplaced || target == ErrUnsafePath
+}
+
+// FileFromPath parses file from relative path produced by SafePath, that
+// can come from untrusted input. Paths that are absolute, have traversal or
+// are not canonical are rejected with ErrUnsafePath, and FileDirError is returned
+// if directory is not the first prefixLenght chars of hash.
+func FileFromPath(p string) (f File, err error) {
+	if path.IsAbs(p) || strings.Contains(p, "..") || strings.Contains(p, "\\") {
+		return f, ErrUnsafePath
+	}
+	elems := strings.Split(p, "/")
+	if len(elems) != 2 {
+		return f, ErrUnsafePath
+	}
+	if f, err = FileFromID(elems[1]); err != nil {
+		return f, err
+	}
+	if dir := f.Dir(); elems[0] != dir {
+		return f, FileDirError{File: f, Dir: elems[0], Expected: dir}
+	}
+	if f.SafePath() != p {
+		return f, ErrUnsafePath
+	}
+	return f, nil
 }
 
 // Use sets LastUsage to current time
@@ -330,59 +975,419 @@ func (f *File) SetHash(s string) error {
 	return nil
 }
 
+// maxResolution is maximum width or height that can be serialized
+const maxResolution = 1<<(8*resolutionBytes) - 1
+
+// WithResolution returns copy of file with provided width and height,
+// or ErrBadResolution if they can't be serialized.
+// Dimensions are part of file id, but not of hash, so changing them changes
+// String and Path of file, while it is still the same file physically.
+func (f File) WithResolution(width, height int) (File, error) {
+	if width < 0 || width > maxResolution || height < 0 || height > maxResolution {
+		return f, ErrBadResolution
+	}
+	f.Width, f.Height = width, height
+	return f, nil
+}
+
 // Buffer creates buffer with size of file
 func (f *File) Buffer() *bytes.Buffer {
 	return bytes.NewBuffer(make([]byte, 0, f.Size))
 }
 
-// FileFromID generates new File from provided ID
-func FileFromID(fileid string) (f File, err error) {
-	elems := strings.Split(fileid, keyStampDelimiter)
-	if len(elems) != 5 {
-		return f, io.ErrUnexpectedEOF
+// FileFromID generates new File from provided ID, with LastUsage set to now,
+// and validates it with File.Validate, so malformed ids, e.g. with unknown type,
+// are rejected early. Use FileFromNameSep to parse id without validation.
+func FileFromID(fileid string) (File, error) {
+	return FileFromIDAt(fileid, time.Now())
+}
+
+// FileFromIDAt is FileFromID with LastUsage set to provided now instead of time.Now()
+func FileFromIDAt(fileid string, now time.Time) (File, error) {
+	f, _, err := parseFileID(fileid, keyStampDelimiter, now)
+	if err != nil {
+		return f, err
 	}
-	if err = f.SetHash(elems[0]); err != nil {
-		return
+	return f, f.Validate()
+}
+
+// FileIDError is returned by FileFromIDStrict and File.Validate
+// and names field of file that failed to parse or is invalid
+type FileIDError struct {
+	Field string
+	Err   error
+}
+
+func (e FileIDError) Error() string {
+	return fmt.Sprintf("hath => bad file %s: %v", e.Field, e.Err)
+}
+
+// Unwrap returns underlying error
+func (e FileIDError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true for ErrInvalidFileID, so all parsing errors can be checked at once
+func (e FileIDError) Is(target error) bool {
+	return target == ErrInvalidFileID
+}
+
+// ErrLastUsageInFuture when last usage of file is too far in future to be real
+var ErrLastUsageInFuture = errors.New("hath => last usage is in future")
+
+// maxLastUsageDrift is how far in future last usage can be, in seconds,
+// so files of clients with bit skewed clocks are still valid
+const maxLastUsageDrift = 24 * 60 * 60
+
+// Validate checks that all fields of file are sane before storing it, that is
+// hash is set, type is known, size is positive and at most FileMaximumSize,
+// width and height are positive and can be serialized, and last usage
+// is not in future. Returns FileIDError for first invalid field.
+func (f File) Validate() error {
+	var (
+		field string
+		err   error
+	)
+	switch {
+	case f.Hash == [HashSize]byte{}:
+		field, err = "hash", ErrHashEmpty
+	case f.Type == UnknownImage:
+		field, err = "type", ErrFileTypeUnknown
+	case f.Size <= 0:
+		field, err = "size", ErrFileBadLength
+	case f.Size > FileMaximumSize:
+		field, err = "size", ErrFileTooLarge
+	case f.Width <= 0 || f.Width > maxResolution:
+		field, err = "width", ErrBadResolution
+	case f.Height <= 0 || f.Height > maxResolution:
+		field, err = "height", ErrBadResolution
+	case f.LastUsage > time.Now().Unix()+maxLastUsageDrift:
+		field, err = "last usage", ErrLastUsageInFuture
+	default:
+		return nil
 	}
-	f.Size, err = strconv.ParseInt(elems[1], 10, 64)
+	return FileIDError{Field: field, Err: err}
+}
+
+// FileFromIDStrict is FileFromID that also returns FileIDError naming failed
+// field if id can't be parsed, not only if parsed file is invalid.
+func FileFromIDStrict(fileid string) (File, error) {
+	f, field, err := parseFileID(fileid, keyStampDelimiter, time.Now())
 	if err != nil {
-		return
+		return f, FileIDError{Field: field, Err: err}
 	}
-	f.Width, err = strconv.Atoi(elems[2])
-	if err != nil {
-		return
+	return f, f.Validate()
+}
+
+// FileFromNameSep is FileFromID for id produced by StringSep with provided separator,
+// but file is not validated, e.g. unknown type is parsed as UnknownImage.
+// Returns ErrBadSeparator if separator is empty or has letters or digits.
+func FileFromNameSep(name, sep string) (f File, err error) {
+	if !validSeparator(sep) {
+		return f, ErrBadSeparator
 	}
-	f.Height, err = strconv.Atoi(elems[3])
-	if err != nil {
-		return
+	f, _, err = parseFileID(name, sep, time.Now())
+	return f, err
+}
+
+// parseFileID parses file id with provided separator and LastUsage set to now, returning
+// name of field that failed to parse along with error. Hash is parsed first.
+func parseFileID(name, sep string, now time.Time) (f File, field string, err error) {
+	elems := strings.Split(name, sep)
+	if len(elems) != FileIDFields {
+		return f, "id", ErrInvalidFileID
+	}
+	if err = f.SetHash(elems[0]); err != nil {
+		return f, "hash", err
+	}
+	if f.Size, err = strconv.ParseInt(elems[1], 10, 64); err != nil {
+		return f, "size", err
+	}
+	if f.Width, err = strconv.Atoi(elems[2]); err != nil {
+		return f, "width", err
+	}
+	if f.Height, err = strconv.Atoi(elems[3]); err != nil {
+		return f, "height", err
 	}
 	f.Type = ParseFileType(elems[4])
-	f.LastUsage = time.Now().Unix()
-	return f, err
+	f.LastUsage = now.Unix()
+	return f, "", nil
 }
 
+const (
+	// FileIDSeparator separates fields of file id, see File.String
+	FileIDSeparator = keyStampDelimiter
+	// FileIDFields is count of fields in file id: hash, size, width, height and type
+	FileIDFields = 5
+)
+
+// BuildFileID joins components of file id with FileIDSeparator without parsing
+// or validating them, so tooling can build ids in canonical format without File.
+func BuildFileID(hash, size, width, height string, t FileType) string {
+	return strings.Join([]string{hash, size, width, height, t.String()}, FileIDSeparator)
+}
+
+// ParseFileID splits file id into components, that can be joined back by BuildFileID.
+// Only count of fields is checked, returning ErrInvalidFileID on mismatch, while
+// components are not parsed, so unlike FileFromID it does not construct File.
+// Unknown type name is returned as UnknownImage and is not preserved by BuildFileID.
+func ParseFileID(id string) (hash, size, width, height string, t FileType, err error) {
+	elems := strings.Split(id, FileIDSeparator)
+	if len(elems) != FileIDFields {
+		return "", "", "", "", UnknownImage, ErrInvalidFileID
+	}
+	return elems[0], elems[1], elems[2], elems[3], ParseFileType(elems[4]), nil
+}
+
+// fileIDBufferSize is enough to format file id with built-in type without growing buffer:
+// hex hash, three 20-char numbers, type and delimiters
+const fileIDBufferSize = HashSize*2 + 3*20 + 8 + 4
+
+// String returns file id, that is hex hash, size, width, height and type joined by keyStampDelimiter.
+// Id is formatted into buffer on stack, so only resulting string is allocated.
 func (f File) String() string {
-	elems := []string{
-		f.HexID(),
-		sInt64(f.Size),
-		strconv.Itoa(f.Width),
-		strconv.Itoa(f.Height),
-		f.Type.String(),
+	var buf [fileIDBufferSize]byte
+	return string(f.appendID(buf[:0], keyStampDelimiter))
+}
+
+// StringSep is String with custom separator instead of keyStampDelimiter, that can be
+// parsed back by FileFromNameSep. Returns ErrBadSeparator if separator is not valid
+// (see FileFromNameSep).
+func (f File) StringSep(sep string) (string, error) {
+	if !validSeparator(sep) {
+		return "", ErrBadSeparator
 	}
-	return strings.Join(elems, keyStampDelimiter)
+	var buf [fileIDBufferSize]byte
+	return string(f.appendID(buf[:0], sep)), nil
 }
 
-// KeyStamp generates file key for provided timestamp
-func (f File) KeyStamp(key string, timestamp int64) string {
+// appendID appends file id with provided separator to b
+func (f File) appendID(b []byte, sep string) []byte {
+	start := len(b)
+	b = append(b, make([]byte, HashSize*2)...)
+	hex.Encode(b[start:], f.Hash[:])
+	b = append(b, sep...)
+	b = strconv.AppendInt(b, f.Size, intBase)
+	b = append(b, sep...)
+	b = strconv.AppendInt(b, int64(f.Width), intBase)
+	b = append(b, sep...)
+	b = strconv.AppendInt(b, int64(f.Height), intBase)
+	b = append(b, sep...)
+	return append(b, f.Type.String()...)
+}
+
+// validSeparator returns true if sep is not empty and has no letters or digits,
+// so it can't be confused with hash, numbers or type name in file id
+func validSeparator(sep string) bool {
+	if sep == "" {
+		return false
+	}
+	for _, c := range sep {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// BinaryToID converts serialized file (see File.Bytes) to file id
+func BinaryToID(b []byte) (string, error) {
+	f, err := FileFromBytes(b)
+	if err != nil {
+		return "", err
+	}
+	if f.Hash == [HashSize]byte{} {
+		return "", ErrHashEmpty
+	}
+	if f.Type == UnknownImage || f.Type.String() == "tmp" {
+		return "", ErrFileTypeUnknown
+	}
+	return f.String(), nil
+}
+
+// IDToBinary converts file id to serialized file (see File.Bytes).
+// Id has no LastUsage and Static, so they are zero.
+func IDToBinary(id string) ([]byte, error) {
+	f, err := FileFromNameSep(id, keyStampDelimiter)
+	if err != nil {
+		return nil, err
+	}
+	if f.Type == UnknownImage {
+		return nil, ErrFileTypeUnknown
+	}
+	f.LastUsage = 0
+	return f.Bytes(), nil
+}
+
+// keyStampMessage returns message that is hashed to produce KeyStamp
+func (f File) keyStampMessage(key string, timestamp int64) []byte {
 	elems := []string{
 		sInt64(timestamp),
 		f.String(),
 		key,
 		keyStampEnd,
 	}
-	toHash := strings.Join(elems, keyStampDelimiter)
-	hash := sha1.Sum([]byte(toHash))
-	return fmt.Sprintf("%x", hash)[:keyStampLength]
+	return []byte(strings.Join(elems, keyStampDelimiter))
+}
+
+// keyStampDigest returns sha1 digest that KeyStamp is derived from
+func (f File) keyStampDigest(key string, timestamp int64) [sha1.Size]byte {
+	return sha1.Sum(f.keyStampMessage(key, timestamp))
+}
+
+// ErrKeyStampLength when KeyStamper length is out of allowed range
+var ErrKeyStampLength = errors.New("hath => key stamp length out of range")
+
+// KeyStamper generates hex key stamps of configurable length and digest.
+// Zero value produces stamps of public protocol, that are first 10 hex chars
+// (40 bits) of sha1, which is weak against offline brute force if key leaks,
+// so deployments that are not bound to hath network can use longer stamps
+// or other digest.
+type KeyStamper struct {
+	length int
+	hash   func() hash.Hash
+}
+
+// NewKeyStamper returns sha1 KeyStamper with provided stamp length in hex chars,
+// or ErrKeyStampLength if length is less than 8 (32 bits) or longer than sha1 digest.
+func NewKeyStamper(length int) (KeyStamper, error) {
+	return NewKeyStamperHash(nil, length)
+}
+
+// NewKeyStamperHash returns KeyStamper that uses digest of h with provided stamp length
+// in hex chars, or ErrKeyStampLength if length is less than 8 (32 bits) or longer than
+// hex digest. If h is nil, sha1 is used, like in KeyStamp.
+func NewKeyStamperHash(h func() hash.Hash, length int) (KeyStamper, error) {
+	k := KeyStamper{length: length, hash: h}
+	if length < keyStampMinLength || length > k.maxLength() {
+		return KeyStamper{}, ErrKeyStampLength
+	}
+	return k, nil
+}
+
+// maxLength returns length of whole hex digest
+func (k KeyStamper) maxLength() int {
+	if k.hash == nil {
+		return keyStampMaxLength
+	}
+	return k.hash().Size() * 2
+}
+
+// Length returns length of stamp in hex chars
+func (k KeyStamper) Length() int {
+	if k.length == 0 {
+		return keyStampLength
+	}
+	return k.length
+}
+
+// SecurityBits returns entropy of stamp in bits, that is 4 bits per hex char
+func (k KeyStamper) SecurityBits() int {
+	return k.Length() * 4
+}
+
+// Stamp generates key stamp of file for provided key and timestamp
+func (k KeyStamper) Stamp(f File, key string, timestamp int64) string {
+	if k.hash == nil {
+		digest := f.keyStampDigest(key, timestamp)
+		return hex.EncodeToString(digest[:])[:k.Length()]
+	}
+	h := k.hash()
+	h.Write(f.keyStampMessage(key, timestamp))
+	return hex.EncodeToString(h.Sum(nil))[:k.Length()]
+}
+
+// KeyStamp generates file key for provided timestamp
+func (f File) KeyStamp(key string, timestamp int64) string {
+	return KeyStamper{}.Stamp(f, key, timestamp)
+}
+
+// VerifyKeyStamp returns true if provided stamp is valid KeyStamp for key and timestamp,
+// comparing stamps in constant time
+func (f File) VerifyKeyStamp(key string, timestamp int64, provided string) bool {
+	expected := f.KeyStamp(key, timestamp)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(provided)) == 1
+}
+
+// VerifyKeyStampWithin is VerifyKeyStamp that also returns false if timestamp
+// differs from now by more than window in any direction, so stamp expires
+// after window and clock skew is limited by same window.
+func (f File) VerifyKeyStampWithin(key string, timestamp int64, provided string, window time.Duration, now time.Time) bool {
+	delta := now.Unix() - timestamp
+	if delta < 0 {
+		delta = -delta
+	}
+	if delta > int64(window/time.Second) {
+		return false
+	}
+	return f.VerifyKeyStamp(key, timestamp, provided)
+}
+
+// KeyStampURL is compact variant of KeyStamp for private deployments,
+// that encodes same truncated digest as unpadded base64url instead of hex.
+// It is not accepted by hath network, which uses KeyStamp.
+func (f File) KeyStampURL(key string, timestamp int64) string {
+	hash := f.keyStampDigest(key, timestamp)
+	return base64.RawURLEncoding.EncodeToString(hash[:keyStampURLBytes])
+}
+
+// VerifyKeyStampURL returns true if stamp is valid KeyStampURL for provided key and timestamp
+func (f File) VerifyKeyStampURL(key string, timestamp int64, stamp string) bool {
+	expected := f.KeyStampURL(key, timestamp)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(stamp)) == 1
+}
+
+// tokenExpiryLayout is readable UTC format of expiry in SignedToken without keyStampDelimiter
+const tokenExpiryLayout = "20060102T150405Z"
+
+var (
+	// ErrTokenInvalid when token is malformed or signature does not match
+	ErrTokenInvalid = errors.New("hath => token is invalid")
+	// ErrTokenExpired when token has valid signature, but is expired
+	ErrTokenExpired = errors.New("hath => token is expired")
+)
+
+// tokenSignature returns HMAC-SHA1 of expiry and file id
+func (f File) tokenSignature(key string, expiry string) []byte {
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write([]byte(expiry))
+	mac.Write([]byte(keyStampDelimiter))
+	mac.Write([]byte(f.String()))
+	return mac.Sum(nil)
+}
+
+// SignedToken returns tamper-evident token for file that is valid until expiry.
+// Token is expiry in readable UTC form (e.g. 20151016T120000Z), delimiter and
+// base64url HMAC of expiry and file id, so expiry can't be changed without key.
+// Expiry is truncated to seconds.
+func (f File) SignedToken(key string, expiry time.Time) string {
+	e := expiry.UTC().Format(tokenExpiryLayout)
+	return e + keyStampDelimiter + base64.RawURLEncoding.EncodeToString(f.tokenSignature(key, e))
+}
+
+// VerifyToken checks that token is produced by SignedToken for file f with key
+// and is not expired at now. Signature is compared in constant time before expiry is checked.
+// Returns ErrTokenInvalid or ErrTokenExpired.
+func VerifyToken(token string, f File, key string, now time.Time) error {
+	elems := strings.SplitN(token, keyStampDelimiter, 2)
+	if len(elems) != 2 {
+		return ErrTokenInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(elems[1])
+	if err != nil {
+		return ErrTokenInvalid
+	}
+	if !hmac.Equal(signature, f.tokenSignature(key, elems[0])) {
+		return ErrTokenInvalid
+	}
+	expiry, err := time.Parse(tokenExpiryLayout, elems[0])
+	if err != nil {
+		return ErrTokenInvalid
+	}
+	if !now.Before(expiry) {
+		return ErrTokenExpired
+	}
+	return nil
 }
 
 // Basex returns basex representation of hash
@@ -394,11 +1399,62 @@ func (f File) Basex() string {
 	return s
 }
 
-// Marshal serializes file info
+// SetBasex sets hash from basex representation (see File.Basex),
+// returning ErrHashBadLength if it does not fit in HashSize bytes.
+// Leading zero bytes of hash are lost in basex, so hash is left-padded.
+func (f *File) SetBasex(s string) error {
+	if s == "" {
+		return ErrHashBadLength
+	}
+	decoded, err := basex.Decode(s)
+	if err != nil {
+		return err
+	}
+	n, ok := new(big.Int).SetString(decoded, 10)
+	if !ok {
+		return ErrHashBadLength
+	}
+	b := n.Bytes()
+	if len(b) > HashSize {
+		return ErrHashBadLength
+	}
+	var hash [HashSize]byte
+	copy(hash[HashSize-len(b):], b)
+	f.Hash = hash
+	return nil
+}
+
+var (
+	// ErrSizeOverflow when file size is negative or greater than FileMaximumSize,
+	// so it is rejected both on serialization and deserialization
+	ErrSizeOverflow = errors.New("hath => file size is out of range")
+	// ErrLastUsageOverflow when last usage can't be serialized in 5 bytes
+	ErrLastUsageOverflow = errors.New("hath => last usage can't be serialized")
+)
+
+// Marshal serializes file info like File.Bytes, but returns ErrSizeOverflow or
+// ErrLastUsageOverflow instead of silently dropping higher bytes of Size or LastUsage.
+// Size is limited by FileMaximumSize, same as in FileFromBytes, so any marshaled
+// file can be unmarshaled back.
 func (f File) Marshal() ([]byte, error) {
+	if err := f.checkSerializable(); err != nil {
+		return nil, err
+	}
 	return f.Bytes(), nil
 }
 
+// checkSerializable returns ErrSizeOverflow or ErrLastUsageOverflow if Size
+// or LastUsage can't be serialized without loss or deserialized back
+func (f File) checkSerializable() error {
+	if f.Size < 0 || f.Size > FileMaximumSize {
+		return ErrSizeOverflow
+	}
+	if f.LastUsage < 0 || f.LastUsage > maxLastUsage {
+		return ErrLastUsageOverflow
+	}
+	return nil
+}
+
 // UnmarshalFile deserializes file info fron byte array
 func UnmarshalFile(data []byte) (f File, err error) {
 	return f, FileFromBytesTo(data, &f)
@@ -409,6 +1465,222 @@ func UnmarshalFileTo(data []byte, f *File) error {
 	return FileFromBytesTo(data, f)
 }
 
+// fileJSON is JSON representation of File, with hex hash and type name
+type fileJSON struct {
+	Hash      string `json:"hash"`
+	Type      string `json:"type"`
+	Static    bool   `json:"static"`
+	Size      int64  `json:"size"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	LastUsage int64  `json:"last_usage"`
+}
+
+// MarshalJSON implements json.Marshaler, encoding hash as lowercase hex
+// like HexID and type as its name, while other fields are numbers
+func (f File) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fileJSON{
+		Hash:      f.HexID(),
+		Type:      f.Type.String(),
+		Static:    f.Static,
+		Size:      f.Size,
+		Width:     f.Width,
+		Height:    f.Height,
+		LastUsage: f.LastUsage,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler for JSON produced by MarshalJSON.
+// Returns error of SetHash for invalid hash, or ErrFileTypeUnknown if type is not known.
+func (f *File) UnmarshalJSON(b []byte) error {
+	var v fileJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	var parsed File
+	if err := parsed.SetHash(v.Hash); err != nil {
+		return err
+	}
+	if parsed.Type = ParseFileType(v.Type); parsed.Type == UnknownImage {
+		return ErrFileTypeUnknown
+	}
+	parsed.Static = v.Static
+	parsed.Size = v.Size
+	parsed.Width = v.Width
+	parsed.Height = v.Height
+	parsed.LastUsage = v.LastUsage
+	*f = parsed
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, see File.Marshal
+func (f File) MarshalBinary() ([]byte, error) {
+	return f.Marshal()
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, see FileFromBytesTo.
+// Returns ErrFileInconsistent if data length is not FileBytes.
+func (f *File) UnmarshalBinary(data []byte) error {
+	return FileFromBytesTo(data, f)
+}
+
+// FileAt reads serialized file (see File.Bytes) from r at offset.
+// Only current layout is read, as layout can't be detected in stream.
+// If less than FileBytes are available, io.ErrUnexpectedEOF is returned.
+func FileAt(r io.ReaderAt, offset int64) (f File, err error) {
+	var buf [FileBytes]byte
+	n, err := r.ReadAt(buf[:], offset)
+	if n < FileBytes {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return f, err
+	}
+	return f, FileFromBytesTo(buf[:], &f)
+}
+
+// MergeFile merges metadata of two records of the same file, reported by different sources.
+// Result does not depend on argument order, so nodes merging independently reach the same result:
+//   - LastUsage is the latest of both;
+//   - Size, Width and Height are the largest of both, as larger is assumed to be more complete;
+//   - Static is set if any of records is static;
+//   - Type is known one if other is UnknownImage, or the lowest one if both are known.
+//
+// If hashes differ, records are not merged: conflict is logged and record
+// with the lowest hash is returned unchanged.
+func MergeFile(a, b File) File {
+	if a.Hash != b.Hash {
+		log.Println("hath:", "unable to merge files with different hashes", a, b)
+		if bytes.Compare(a.Hash[:], b.Hash[:]) > 0 {
+			return b
+		}
+		return a
+	}
+	if b.LastUsage > a.LastUsage {
+		a.LastUsage = b.LastUsage
+	}
+	if b.Size > a.Size {
+		a.Size = b.Size
+	}
+	if b.Width > a.Width {
+		a.Width = b.Width
+	}
+	if b.Height > a.Height {
+		a.Height = b.Height
+	}
+	a.Static = a.Static || b.Static
+	if a.Type == UnknownImage || (b.Type != UnknownImage && b.Type < a.Type) {
+		a.Type = b.Type
+	}
+	return a
+}
+
+// Comparators below are suitable for slices.SortFunc and slices.BinarySearchFunc.
+// All of them break ties by hash, so order of any inventory is total and
+// same on every run and node, regardless of initial order and sort stability.
+
+// CompareFiles compares files by hash and returns -1, 0 or +1.
+func CompareFiles(a, b File) int {
+	return bytes.Compare(a.Hash[:], b.Hash[:])
+}
+
+// CompareByUsage compares files by LastUsage, least recently used first.
+func CompareByUsage(a, b File) int {
+	if c := compareInt64(a.LastUsage, b.LastUsage); c != 0 {
+		return c
+	}
+	return CompareFiles(a, b)
+}
+
+// CompareBySize compares files by Size, smallest first.
+func CompareBySize(a, b File) int {
+	if c := compareInt64(a.Size, b.Size); c != 0 {
+		return c
+	}
+	return CompareFiles(a, b)
+}
+
+// CompareByType compares files by Type.
+func CompareByType(a, b File) int {
+	if c := compareInt64(int64(a.Type), int64(b.Type)); c != 0 {
+		return c
+	}
+	return CompareFiles(a, b)
+}
+
+// FilesByHash implements sort.Interface ordering files by hash, see CompareFiles
+type FilesByHash []File
+
+func (s FilesByHash) Len() int           { return len(s) }
+func (s FilesByHash) Less(i, j int) bool { return CompareFiles(s[i], s[j]) < 0 }
+func (s FilesByHash) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// FilesByLastUsage implements sort.Interface ordering files by last usage, least recently
+// used first, with ties broken by hash, see CompareByUsage
+type FilesByLastUsage []File
+
+func (s FilesByLastUsage) Len() int           { return len(s) }
+func (s FilesByLastUsage) Less(i, j int) bool { return CompareByUsage(s[i], s[j]) < 0 }
+func (s FilesByLastUsage) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// ContentKey is comparable identity of file content, that can be used as map key.
+// Hash alone identifies bytes on disk, but in hath file id includes type, so
+// same hash with different types are different files for clients and must not be deduplicated.
+type ContentKey struct {
+	Hash [HashSize]byte
+	Type FileType
+}
+
+// ContentKey returns identity of file content
+func (f File) ContentKey() ContentKey {
+	return ContentKey{Hash: f.Hash, Type: f.Type}
+}
+
+// Clone returns copy of file. File has no reference fields, so
+// assignment copies it too, and Clone only expresses intent to get
+// independent copy that can be modified without affecting f.
+func (f File) Clone() File {
+	return f
+}
+
+// CopyFrom copies all fields of other to f, reusing f
+func (f *File) CopyFrom(other File) {
+	*f = other
+}
+
+// Equal returns true if files have same metadata, that is all fields except LastUsage,
+// which changes on every access and usually should not be treated as change of file.
+// Use Identical to compare LastUsage too.
+func (f File) Equal(other File) bool {
+	f.LastUsage = other.LastUsage
+	return f == other
+}
+
+// Identical returns true if all fields of files are equal, including LastUsage
+func (f File) Identical(other File) bool {
+	return f == other
+}
+
+// HashDistance returns Hamming distance between hashes, that is count of differing bits
+func HashDistance(a, b [HashSize]byte) int {
+	var d int
+	for i := range a {
+		d += bits.OnesCount8(a[i] ^ b[i])
+	}
+	return d
+}
+
 // ByteID returns []byte for file hash
 func (f File) ByteID() []byte {
 	return f.Hash[:]
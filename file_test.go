@@ -3,11 +3,23 @@ package hath
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	mrand "math/rand"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -48,6 +60,49 @@ func TestFile(t *testing.T) {
 			f.Use()
 			So(f.LastUsage, ShouldEqual, time.Now().Unix())
 		})
+		Convey("Last usage in UTC", func() {
+			f := File{LastUsage: 1445000000}
+			So(f.LastUsageUTC().Location(), ShouldEqual, time.UTC)
+			So(f.LastUsageUTC().Unix(), ShouldEqual, f.LastUsage)
+			deadline := time.Unix(1445000100, 0)
+			zone := time.FixedZone("UTC+3", 3*60*60)
+			So(f.LastUsageBefore(deadline.In(zone)), ShouldEqual, f.LastUsageBefore(deadline.UTC()))
+			So(f.LastUsageBefore(deadline.In(zone)), ShouldEqual, f.LastUsageBefore(deadline))
+			So(f.LastUsageBefore(deadline), ShouldBeTrue)
+			So(f.LastUsageBefore(f.LastUsageUTC()), ShouldBeFalse)
+			So(f.LastUsageBefore(time.Unix(1444999999, 0)), ShouldBeFalse)
+		})
+		Convey("Last usage before", func() {
+			today := time.Now()
+			f := File{LastUsage: today.Add(-24 * time.Hour).Unix()}
+			So(f.LastUsageBefore(today), ShouldBeTrue)
+			f.LastUsage = today.Add(time.Hour).Unix()
+			So(f.LastUsageBefore(today), ShouldBeFalse)
+		})
+		Convey("Age", func() {
+			now := time.Unix(1445000000, 0)
+			f := File{LastUsage: now.Add(-30 * 24 * time.Hour).Unix()}
+			So(f.AgeAt(now), ShouldEqual, 30*24*time.Hour)
+			So(f.Age(), ShouldBeGreaterThan, 30*24*time.Hour)
+			f.LastUsage = now.Add(time.Hour).Unix()
+			So(f.AgeAt(now), ShouldEqual, -time.Hour)
+			f.LastUsage = 0
+			So(f.AgeAt(now), ShouldEqual, time.Duration(now.Unix())*time.Second)
+		})
+		Convey("Expired", func() {
+			now := time.Unix(1445000000, 0)
+			f := File{LastUsage: now.Add(-2 * time.Hour).Unix()}
+			So(f.IsExpired(now, time.Hour), ShouldBeTrue)
+			So(f.IsExpired(now, 3*time.Hour), ShouldBeFalse)
+			So(f.IsExpired(now, 2*time.Hour), ShouldBeFalse)
+			Convey("Static", func() {
+				f.Static = true
+				f.LastUsage = 0
+				So(f.IsExpired(now, time.Hour), ShouldBeFalse)
+				So(f.IsExpired(now, 0), ShouldBeFalse)
+				So(f.IsExpired(now.Add(100*365*24*time.Hour), time.Second), ShouldBeFalse)
+			})
+		})
 	})
 }
 
@@ -98,7 +153,7 @@ func TestFileSerialization(t *testing.T) {
 		Convey("Serialize", func() {
 			f := g.NewFake()
 			b := f.Bytes()
-			So(len(b), ShouldEqual, fileBytes)
+			So(len(b), ShouldEqual, FileBytes)
 			Convey("Deserialize", func() {
 				resultFile, err := FileFromBytes(b)
 				So(err, ShouldBeNil)
@@ -123,6 +178,25 @@ func TestFileSerialization(t *testing.T) {
 			}
 			So(failures, ShouldEqual, 0)
 		})
+		Convey("Binary", func() {
+			f := g.NewFake()
+			b, err := f.MarshalBinary()
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, f.Bytes())
+			var parsed File
+			So(parsed.UnmarshalBinary(b), ShouldBeNil)
+			So(parsed, ShouldResemble, f)
+			So(parsed.UnmarshalBinary(nil), ShouldEqual, ErrFileInconsistent)
+			So(parsed.UnmarshalBinary(b[1:]), ShouldEqual, ErrFileInconsistent)
+		})
+		Convey("Gob", func() {
+			files := []File{g.NewFake(), g.NewFake(), g.NewFake()}
+			buf := new(bytes.Buffer)
+			So(gob.NewEncoder(buf).Encode(files), ShouldBeNil)
+			var decoded []File
+			So(gob.NewDecoder(buf).Decode(&decoded), ShouldBeNil)
+			So(decoded, ShouldResemble, files)
+		})
 	})
 }
 
@@ -133,7 +207,7 @@ func TestFileMarshalling(t *testing.T) {
 			f := g.NewFake()
 			b, err := f.Marshal()
 			So(err, ShouldBeNil)
-			So(len(b), ShouldEqual, fileBytes)
+			So(len(b), ShouldEqual, FileBytes)
 			Convey("Deserialize", func() {
 				resultFile, err := FileFromBytes(b)
 				So(err, ShouldBeNil)
@@ -179,15 +253,197 @@ func TestFileID(t *testing.T) {
 			gotKeystamp := f.KeyStamp("key", 10666)
 			expectedKeystamp := "71cf950fcd"
 			So(gotKeystamp, ShouldEqual, expectedKeystamp)
+			Convey("Stamper", func() {
+				So(KeyStamper{}.Stamp(f, "key", 10666), ShouldEqual, expectedKeystamp)
+				So(KeyStamper{}.SecurityBits(), ShouldEqual, 40)
+				k, err := NewKeyStamper(32)
+				So(err, ShouldBeNil)
+				So(k.SecurityBits(), ShouldEqual, 128)
+				stamp := k.Stamp(f, "key", 10666)
+				So(stamp, ShouldHaveLength, 32)
+				So(stamp, ShouldStartWith, expectedKeystamp)
+				k, err = NewKeyStamper(keyStampMinLength)
+				So(err, ShouldBeNil)
+				So(k.SecurityBits(), ShouldEqual, 32)
+				for _, length := range []int{0, keyStampMinLength - 1, keyStampMaxLength + 1} {
+					_, err := NewKeyStamper(length)
+					So(err, ShouldEqual, ErrKeyStampLength)
+				}
+				Convey("Hash", func() {
+					k, err := NewKeyStamperHash(nil, keyStampLength)
+					So(err, ShouldBeNil)
+					So(k.Stamp(f, "key", 10666), ShouldEqual, expectedKeystamp)
+					k, err = NewKeyStamperHash(sha256.New, sha256.Size*2)
+					So(err, ShouldBeNil)
+					digest := sha256.Sum256([]byte("10666-070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png-key-hotlinkthis"))
+					So(k.Stamp(f, "key", 10666), ShouldEqual, hex.EncodeToString(digest[:]))
+					_, err = NewKeyStamperHash(sha256.New, sha256.Size*2+1)
+					So(err, ShouldEqual, ErrKeyStampLength)
+				})
+			})
+		})
+		Convey("Verify key stamp", func() {
+			stamp := f.KeyStamp("key", 10666)
+			So(f.VerifyKeyStamp("key", 10666, stamp), ShouldBeTrue)
+			tampered := []byte(stamp)
+			tampered[0]++
+			So(f.VerifyKeyStamp("key", 10666, string(tampered)), ShouldBeFalse)
+			So(f.VerifyKeyStamp("key", 10666, stamp[:9]), ShouldBeFalse)
+			So(f.VerifyKeyStamp("key", 10667, stamp), ShouldBeFalse)
+			So(f.VerifyKeyStamp("key2", 10666, stamp), ShouldBeFalse)
+			Convey("Window", func() {
+				now := time.Unix(10666, 0)
+				So(f.VerifyKeyStampWithin("key", 10666, stamp, time.Minute, now), ShouldBeTrue)
+				So(f.VerifyKeyStampWithin("key", 10666, stamp, time.Minute, now.Add(time.Minute)), ShouldBeTrue)
+				So(f.VerifyKeyStampWithin("key", 10666, stamp, time.Minute, now.Add(time.Minute+time.Second)), ShouldBeFalse)
+				So(f.VerifyKeyStampWithin("key", 10666, stamp, time.Minute, now.Add(-2*time.Minute)), ShouldBeFalse)
+				So(f.VerifyKeyStampWithin("key", 10666, string(tampered), time.Minute, now), ShouldBeFalse)
+			})
+		})
+		Convey("Keystamp URL", func() {
+			stamp := f.KeyStampURL("key", 10666)
+			So(stamp, ShouldEqual, "cc-VD80")
+			So(f.VerifyKeyStampURL("key", 10666, stamp), ShouldBeTrue)
+			So(f.VerifyKeyStampURL("key", 10667, stamp), ShouldBeFalse)
+			So(f.VerifyKeyStampURL("key2", 10666, stamp), ShouldBeFalse)
+			So(f.VerifyKeyStampURL("key", 10666, f.KeyStamp("key", 10666)), ShouldBeFalse)
+			So(f.KeyStamp("key", 10666), ShouldEqual, "71cf950fcd")
 		})
 		Convey("BaseX", func() {
 			expectedID := "10JUYVz94XadJT1GdvnVp0E6x3p"
 			So(f.Basex(), ShouldEqual, expectedID)
+			var parsed File
+			So(parsed.SetBasex(expectedID), ShouldBeNil)
+			So(parsed.Hash, ShouldEqual, f.Hash)
+			Convey("Leading zero", func() {
+				var zero, parsed File
+				zero.Hash = f.Hash
+				zero.Hash[0], zero.Hash[1] = 0, 0
+				So(parsed.SetBasex(zero.Basex()), ShouldBeNil)
+				So(parsed.Hash, ShouldEqual, zero.Hash)
+				So(parsed.SetBasex(File{}.Basex()), ShouldBeNil)
+				So(parsed.Hash, ShouldEqual, File{}.Hash)
+			})
+			Convey("Error handling", func() {
+				var parsed File
+				So(parsed.SetBasex(""), ShouldEqual, ErrHashBadLength)
+				So(parsed.SetBasex(expectedID+"00"), ShouldEqual, ErrHashBadLength)
+				So(parsed.SetBasex("not-basex"), ShouldNotBeNil)
+				So(parsed.Hash, ShouldEqual, File{}.Hash)
+			})
 		})
 		Convey("Path", func() {
 			expected := "07/070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png"
 			actual := f.Path()
 			So(expected, ShouldEqual, actual)
+			Convey("Layout", func() {
+				So(DefaultFileLayout.Path(f), ShouldEqual, expected)
+				So(FileLayout{Depth: 1, PrefixLength: 2}.Path(f), ShouldEqual, expected)
+				So(FileLayout{Depth: 2, PrefixLength: 2}.Path(f), ShouldEqual,
+					"07/0b/070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png")
+				So(FileLayout{Depth: 2, PrefixLength: 3}.Dir(f), ShouldEqual, "070/b45")
+				So(FileLayout{}.Path(f), ShouldEqual, f.String())
+				So(FileLayout{Depth: 3, PrefixLength: 20}.Dir(f), ShouldEqual,
+					"070b45ae488fb1967aaf/618561a7d6ba4d28a1c9")
+			})
+		})
+		Convey("Build and parse id", func() {
+			hash, size, width, height, fileType, err := ParseFileID(f.String())
+			So(err, ShouldBeNil)
+			So(hash, ShouldEqual, f.HexID())
+			So(size, ShouldEqual, "12345")
+			So(width, ShouldEqual, "1920")
+			So(height, ShouldEqual, "1080")
+			So(fileType, ShouldEqual, PNG)
+			So(BuildFileID(hash, size, width, height, fileType), ShouldEqual, f.String())
+			for _, id := range []string{
+				"070b45ae488fb1967aaf618561a7d6ba4d28a1c9-1-2-3-jpg",
+				"not-parsed-as-numbers-gif",
+				"----png",
+			} {
+				hash, size, width, height, fileType, err = ParseFileID(id)
+				So(err, ShouldBeNil)
+				So(BuildFileID(hash, size, width, height, fileType), ShouldEqual, id)
+			}
+			underscored, err := f.StringSep("_")
+			So(err, ShouldBeNil)
+			for _, id := range []string{"", "a-b-c-d", "a-b-c-d-e-f", underscored} {
+				_, _, _, _, _, err = ParseFileID(id)
+				So(err, ShouldEqual, ErrInvalidFileID)
+			}
+			So(FileIDSeparator, ShouldEqual, "-")
+			So(strings.Count(f.String(), FileIDSeparator), ShouldEqual, FileIDFields-1)
+		})
+		Convey("Separator", func() {
+			for _, fileType := range []FileType{JPG, PNG, GIF, testTIFF} {
+				typed := f
+				typed.Type = fileType
+				for _, sep := range []string{"_", "~", "::", ".", keyStampDelimiter} {
+					id, err := typed.StringSep(sep)
+					So(err, ShouldBeNil)
+					parsed, err := FileFromNameSep(id, sep)
+					So(err, ShouldBeNil)
+					So(parsed.String(), ShouldEqual, typed.String())
+				}
+			}
+			id, err := f.StringSep("_")
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, "070b45ae488fb1967aaf618561a7d6ba4d28a1c9_12345_1920_1080_png")
+			// letters of type names can't be separators, e.g. "p" or "n" of png
+			for _, sep := range []string{"", "a", "0", "-F-", "p", "g", "n", "x", "_z_", "ж"} {
+				_, err := FileFromNameSep(f.String(), sep)
+				So(err, ShouldEqual, ErrBadSeparator)
+				_, err = f.StringSep(sep)
+				So(err, ShouldEqual, ErrBadSeparator)
+			}
+			_, err = FileFromNameSep(f.String(), "_")
+			So(err, ShouldEqual, ErrInvalidFileID)
+		})
+		Convey("Safe path", func() {
+			p := f.SafePath()
+			So(p, ShouldEqual, f.Path())
+			parsed, err := FileFromPath(p)
+			So(err, ShouldBeNil)
+			So(parsed.Hash, ShouldEqual, f.Hash)
+			So(parsed.Type, ShouldEqual, f.Type)
+			unsafe := []string{
+				"/" + p,
+				"../" + p,
+				"07/../" + p,
+				"07\\070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png",
+				"07/070B45AE488FB1967AAF618561A7D6BA4D28A1C9-12345-1920-1080-png",
+				"07/070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-PNG",
+				"07/070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-jpeg",
+			}
+			for _, example := range unsafe {
+				_, err := FileFromPath(example)
+				So(err, ShouldEqual, ErrUnsafePath)
+			}
+			_, err = FileFromPath("07/one-two-three")
+			So(err, ShouldEqual, ErrInvalidFileID)
+			Convey("Wrong shard", func() {
+				misplaced, err := FileFromPath("08/070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png")
+				So(err, ShouldResemble, FileDirError{File: misplaced, Dir: "08", Expected: "07"})
+				So(misplaced.Hash, ShouldEqual, f.Hash)
+				So(errors.Is(err, ErrFileMisplaced), ShouldBeTrue)
+				So(errors.Is(err, ErrUnsafePath), ShouldBeTrue)
+				So(err.Error(), ShouldEqual, `hath => file 070b45ae488fb1967aaf618561a7d6ba4d28a1c9 is in directory "08" instead of "07"`)
+				_, err = FileFromPath("07b/070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png")
+				So(errors.Is(err, ErrFileMisplaced), ShouldBeTrue)
+			})
+			Convey("Registered type", func() {
+				tiff := f
+				tiff.Type = testTIFF
+				So(tiff.SafePath(), ShouldEqual, "07/070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-tiff")
+			})
+		})
+		Convey("Dir", func() {
+			dir, err := f.DirErr()
+			So(err, ShouldBeNil)
+			So(dir, ShouldEqual, "07")
+			So(f.ShardIndex(), ShouldEqual, 0x07)
+			_, err = File{}.DirErr()
+			So(err, ShouldEqual, ErrHashEmpty)
 		})
 		Convey("Static ranges", func() {
 			ranges := make(StaticRanges)
@@ -199,6 +455,79 @@ func TestFileID(t *testing.T) {
 				ranges.Remove(r)
 				So(ranges.Contains(f), ShouldBeFalse)
 			})
+			Convey("Clone", func() {
+				clone := ranges.Clone()
+				So(clone, ShouldResemble, ranges)
+				clone.Remove(r)
+				So(ranges.Contains(f), ShouldBeTrue)
+				So(clone.Contains(f), ShouldBeFalse)
+				So(StaticRanges(nil).Clone().Count(), ShouldEqual, 0)
+			})
+			Convey("Partition", func() {
+				files := make([]File, 6)
+				for i := range files {
+					files[i].Hash[0] = byte(i % 3)
+					files[i].Size = int64(i)
+				}
+				first, second := StaticRange{0, 0}, StaticRange{1, 0}
+				So(first.Filter(files), ShouldResemble, []File{files[0], files[3]})
+				So(StaticRange{5, 5}.Filter(files), ShouldBeEmpty)
+				ranges := StaticRanges{first: true, second: true, {7, 7}: true}
+				buckets, outside := ranges.Partition(files)
+				So(buckets, ShouldHaveLength, 2)
+				So(buckets[first], ShouldResemble, []File{files[0], files[3]})
+				So(buckets[second], ShouldResemble, []File{files[1], files[4]})
+				So(outside, ShouldResemble, []File{files[2], files[5]})
+			})
+			Convey("Diff", func() {
+				parse := func(s string) StaticRanges {
+					r, err := ParseStaticRanges(s)
+					So(err, ShouldBeNil)
+					return r
+				}
+				old := parse("0000;070b;ffff")
+				assigned := parse("070b;ffff;a1b2")
+				added, removed := old.Diff(assigned)
+				So(added, ShouldResemble, parse("a1b2"))
+				So(removed, ShouldResemble, parse("0000"))
+				So(old.Intersect(assigned), ShouldResemble, parse("070b;ffff"))
+				So(old.String(), ShouldEqual, "0000;070b;ffff")
+				So(assigned.String(), ShouldEqual, "070b;a1b2;ffff")
+
+				added, removed = old.Diff(old.Clone())
+				So(added, ShouldNotBeNil)
+				So(added.Count(), ShouldEqual, 0)
+				So(removed, ShouldNotBeNil)
+				So(removed.Count(), ShouldEqual, 0)
+				added, removed = StaticRanges(nil).Diff(old)
+				So(added, ShouldResemble, old)
+				So(removed.Count(), ShouldEqual, 0)
+				So(old.Intersect(nil).Count(), ShouldEqual, 0)
+			})
+			Convey("Parse", func() {
+				for _, s := range []string{"070b", "0000", "ffff", "a1b2", "c3d4"} {
+					r, err := ParseStaticRange(s)
+					So(err, ShouldBeNil)
+					ranges.Add(r)
+				}
+				parsed, err := ParseStaticRanges(ranges.String())
+				So(err, ShouldBeNil)
+				So(parsed, ShouldResemble, ranges)
+				parsed, err = ParseStaticRanges(";070b; ffff;;")
+				So(err, ShouldBeNil)
+				So(parsed.Count(), ShouldEqual, 2)
+				empty, err := ParseStaticRanges("")
+				So(err, ShouldBeNil)
+				So(empty.Count(), ShouldEqual, 0)
+				_, err = ParseStaticRanges("070b;07b;ffff")
+				So(err, ShouldNotBeNil)
+				rangeErr, ok := err.(StaticRangeError)
+				So(ok, ShouldBeTrue)
+				So(rangeErr.Range, ShouldEqual, "07b")
+				So(err.Error(), ShouldContainSubstring, `"07b"`)
+				_, err = ParseStaticRanges("070b;zzzz")
+				So(err.(StaticRangeError).Range, ShouldEqual, "zzzz")
+			})
 		})
 		Convey("Parsing", func() {
 			fid := "070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png"
@@ -222,6 +551,1069 @@ func TestFileID(t *testing.T) {
 					So(err, ShouldNotBeNil)
 				}
 			})
+			Convey("At", func() {
+				now := time.Unix(1474117323, 0)
+				a, err := FileFromIDAt(fid, now)
+				So(err, ShouldBeNil)
+				b, err := FileFromIDAt(fid, now)
+				So(err, ShouldBeNil)
+				So(a.Identical(b), ShouldBeTrue)
+				So(a.LastUsage, ShouldEqual, now.Unix())
+				So(a.Equal(parsed), ShouldBeTrue)
+				_, err = FileFromIDAt("one-two-three", now)
+				So(err, ShouldEqual, ErrInvalidFileID)
+			})
+			Convey("Strict", func() {
+				strict, err := FileFromIDStrict(fid)
+				So(err, ShouldBeNil)
+				So(strict.Hash, ShouldEqual, parsed.Hash)
+				So(strict.Type, ShouldEqual, PNG)
+				examples := map[string]string{
+					"070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-bmp": "type",
+					"070b45ae488fb1967aaf618561a7d6ba4d28a1c9-?-1920-1080-png":     "size",
+					"070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-pek-1080-png":  "width",
+					"070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1223-2f-png":   "height",
+					"070b45-12345-1920-1080-bmp":                                   "hash",
+					"one-two-three":                                                "id",
+				}
+				for example, field := range examples {
+					_, err := FileFromIDStrict(example)
+					So(err, ShouldNotBeNil)
+					So(err.(FileIDError).Field, ShouldEqual, field)
+					So(err.Error(), ShouldContainSubstring, field)
+				}
+				_, err = FileFromIDStrict("070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-bmp")
+				So(err.(FileIDError).Err, ShouldEqual, ErrFileTypeUnknown)
+				_, err = FileFromID("070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-bmp")
+				So(err, ShouldResemble, FileIDError{Field: "type", Err: ErrFileTypeUnknown})
+				lenient, err := FileFromNameSep("070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-bmp", "-")
+				So(err, ShouldBeNil)
+				So(lenient.Type, ShouldEqual, UnknownImage)
+			})
+		})
+		Convey("Binary", func() {
+			fid := "070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png"
+			b, err := IDToBinary(fid)
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, f.Bytes())
+			id, err := BinaryToID(b)
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, fid)
+			Convey("Error handling", func() {
+				_, err := BinaryToID(b[:FileBytes-1])
+				So(err, ShouldEqual, ErrFileInconsistent)
+				_, err = BinaryToID(File{Type: PNG}.Bytes())
+				So(err, ShouldEqual, ErrHashEmpty)
+				unknown := f
+				unknown.Type = UnknownImage
+				_, err = BinaryToID(unknown.Bytes())
+				So(err, ShouldEqual, ErrFileTypeUnknown)
+				_, err = IDToBinary("one-two-three")
+				So(err, ShouldEqual, ErrInvalidFileID)
+				_, err = IDToBinary("070b45-12345-1920-1080-png")
+				So(err, ShouldEqual, ErrHashBadLength)
+				_, err = IDToBinary("070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-bmp")
+				So(err, ShouldEqual, ErrFileTypeUnknown)
+			})
+		})
+	})
+}
+
+// testTIFF is registered once per test binary, as RegisterFormat panics on duplicates
+var testTIFF = RegisterFormat("tiff", []byte{'I', 'I', '*', 0x00}, "image/tiff")
+
+func TestRegisterFormat(t *testing.T) {
+	Convey("Register format", t, func() {
+		So(testTIFF, ShouldBeGreaterThan, UnknownImage)
+		So(testTIFF.String(), ShouldEqual, "tiff")
+		So(ParseFileType("TIFF"), ShouldEqual, testTIFF)
+		So(ContentTypes[testTIFF], ShouldEqual, "image/tiff")
+		So(File{Type: testTIFF}.ContentType(), ShouldEqual, "image/tiff")
+		Convey("Content type as", func() {
+			f := File{Type: JPG}
+			So(f.ContentTypeAs(testTIFF), ShouldEqual, "image/tiff")
+			So(f.ContentTypeAs(PNG), ShouldEqual, "image/png")
+			So(f.ContentTypeAs(UnknownImage), ShouldEqual, "application/octet-stream")
+			So(f.ContentType(), ShouldEqual, "image/jpeg")
+		})
+		Convey("Detection", func() {
+			So(detectFileType([]byte{'I', 'I', '*', 0x00, 0x08}), ShouldEqual, testTIFF)
+			So(detectFileType([]byte{0xFF, 0xD8, 0xFF, 0xE0}), ShouldEqual, JPG)
+			So(detectFileType([]byte{0x89, 'P', 'N', 'G', '\r', '\n'}), ShouldEqual, PNG)
+			So(detectFileType([]byte("GIF89a")), ShouldEqual, GIF)
+			So(detectFileType([]byte("BM")), ShouldEqual, UnknownImage)
+			So(detectFileType(nil), ShouldEqual, UnknownImage)
+			So(detectFileType([]byte("RIFF\x24\x00\x00\x00WEBPVP8 ")), ShouldEqual, WEBP)
+			So(detectFileType([]byte("RIFF\x24\x00\x00\x00WAVEfmt ")), ShouldEqual, UnknownImage)
+			So(detectFileType([]byte("RIFF")), ShouldEqual, UnknownImage)
+			So(detectFileType([]byte("\x00\x00\x00\x20ftypavif")), ShouldEqual, AVIF)
+			So(detectFileType([]byte("\x00\x00\x00\x20ftypavis")), ShouldEqual, AVIF)
+			So(detectFileType([]byte("\x00\x00\x00\x20ftypheic")), ShouldEqual, UnknownImage)
+		})
+		Convey("Collisions", func() {
+			So(func() {
+				RegisterFormat("jpeg2", []byte{0xFF, 0xD8}, "image/jpeg")
+			}, ShouldPanic)
+			So(func() {
+				RegisterFormat("gif", []byte("XXXX"), "image/gif")
+			}, ShouldPanic)
+			So(func() {
+				RegisterFormat("WebP", []byte("XXXX"), "image/webp")
+			}, ShouldPanic)
+			So(func() {
+				RegisterFormat("tiff2", []byte{'I', 'I', '*', 0x00, 0x01}, "image/tiff")
+			}, ShouldPanic)
+			// containers are registered too
+			So(func() {
+				RegisterFormat("wave", []byte("RIFF"), "audio/wav")
+			}, ShouldPanic)
+			So(func() {
+				RegisterFormat("avif2", []byte("\x00\x00\x00\x1cftypavis"), "image/avif")
+			}, ShouldPanic)
+			heic := fileFormat{magic: []byte("\x00\x00\x00\x1cftypheic")}
+			for _, format := range formats {
+				if format.fileType == AVIF {
+					So(format.collides(heic), ShouldBeFalse)
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkBytes(b *testing.B) {
+	f := defaultGenerator.NewFake()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Bytes()
+	}
+}
+
+func BenchmarkAppendBytes(b *testing.B) {
+	f := defaultGenerator.NewFake()
+	buf := make([]byte, 0, FileBytes)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = f.AppendBytes(buf[:0])
+	}
+}
+
+func BenchmarkAppendBytesGrowing(b *testing.B) {
+	f := defaultGenerator.NewFake()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf []byte
+		for j := 0; j < 1000; j++ {
+			buf = f.AppendBytes(buf)
+		}
+	}
+}
+
+func BenchmarkFileFromBytes(b *testing.B) {
+	data := defaultGenerator.NewFake().Bytes()
+	var f File
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := FileFromBytesTo(data, &f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKeyStamp(b *testing.B) {
+	f := defaultGenerator.NewFake()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.KeyStamp("key", 10666)
+	}
+}
+
+func BenchmarkString(b *testing.B) {
+	f := defaultGenerator.NewFake()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = f.String()
+	}
+}
+
+// fileFromBytesToReference is previous FileFromBytesTo implementation
+// that used 8-byte scratch buffer, kept to check that results are identical,
+// with same size limit and both layouts
+func fileFromBytesToReference(result []byte, f *File) error {
+	if len(result) != FileBytes && len(result) != FileBytesV1 {
+		return ErrFileInconsistent
+	}
+	var buff [8]byte
+	cursor := 0
+	copy(f.Hash[:], result[cursor:HashSize])
+	cursor += HashSize
+	f.Type = FileType(result[cursor])
+	cursor++
+	f.Static = result[cursor] == 255
+	cursor++
+	copy(buff[:sizeBytes], result[cursor:cursor+sizeBytes])
+	f.Size = int64(binary.LittleEndian.Uint64(buff[:]))
+	if f.Size > FileMaximumSize {
+		return ErrSizeOverflow
+	}
+	cursor += sizeBytes
+	buff = [8]byte{}
+	copy(buff[:resolutionBytes], result[cursor:cursor+resolutionBytes])
+	f.Height = int(binary.LittleEndian.Uint64(buff[:]))
+	cursor += resolutionBytes
+	buff = [8]byte{}
+	copy(buff[:resolutionBytes], result[cursor:cursor+resolutionBytes])
+	f.Width = int(binary.LittleEndian.Uint64(buff[:]))
+	cursor += resolutionBytes
+	buff = [8]byte{}
+	copy(buff[:], result[cursor:])
+	f.LastUsage = int64(binary.LittleEndian.Uint64(buff[:]))
+	return nil
+}
+
+func FuzzFileFromBytesTo(f *testing.F) {
+	for i := 0; i < 10; i++ {
+		f.Add(defaultGenerator.NewFake().Bytes())
+	}
+	f.Add(bytes.Repeat([]byte{0xFF}, FileBytes))
+	f.Add(make([]byte, FileBytes))
+	f.Add(fileBytesV1(defaultGenerator.NewFake()))
+	f.Add(bytes.Repeat([]byte{0xFF}, FileBytesV1))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var got, expected File
+		errGot := FileFromBytesTo(data, &got)
+		errExpected := fileFromBytesToReference(data, &expected)
+		if errGot != errExpected {
+			t.Fatalf("%v != %v", errGot, errExpected)
+		}
+		if got != expected {
+			t.Errorf("%+v != %+v", got, expected)
+		}
+	})
+}
+
+func TestFileSize(t *testing.T) {
+	Convey("Size serialization", t, func() {
+		f := defaultGenerator.NewFake()
+		Convey("Round trip up to maximum size", func() {
+			for _, size := range []int64{0, 1, 255, 1 << 16, FileMaximumSize - 1, FileMaximumSize} {
+				f.Size = size
+				parsed, err := FileFromBytes(f.Bytes())
+				So(err, ShouldBeNil)
+				So(parsed, ShouldResemble, f)
+			}
+		})
+		Convey("Larger sizes are rejected", func() {
+			for _, size := range []int64{FileMaximumSize + 1, 1<<32 - 2, 1<<32 - 1} {
+				f.Size = size
+				_, err := FileFromBytes(f.Bytes())
+				So(err, ShouldEqual, ErrSizeOverflow)
+			}
+			// bit flip in highest byte of size
+			f.Size = 1234
+			b := f.Bytes()
+			b[HashSize+2+sizeBytes-1] ^= 0x80
+			_, err := FileFromBytes(b)
+			So(err, ShouldEqual, ErrSizeOverflow)
+		})
+		Convey("Marshal boundary", func() {
+			f.Size = FileMaximumSize
+			b, err := f.Marshal()
+			So(err, ShouldBeNil)
+			parsed, err := FileFromBytes(b)
+			So(err, ShouldBeNil)
+			So(parsed.Size, ShouldEqual, FileMaximumSize)
+			for _, size := range []int64{FileMaximumSize + 1, 20 << 20, 0xFFFFFFFF, 0xFFFFFFFF + 1, 1 << 40, -1} {
+				f.Size = size
+				_, err = f.Marshal()
+				So(err, ShouldEqual, ErrSizeOverflow)
+				_, err = f.MarshalBinary()
+				So(err, ShouldEqual, ErrSizeOverflow)
+			}
+			f.Size = 1234
+			for _, usage := range []int64{maxLastUsage + 1, -1} {
+				f.LastUsage = usage
+				_, err = f.Marshal()
+				So(err, ShouldEqual, ErrLastUsageOverflow)
+			}
+			f.LastUsage = maxLastUsage
+			_, err = f.Marshal()
+			So(err, ShouldBeNil)
+		})
+		Convey("Higher bytes are dropped", func() {
+			f.Size = 1<<32 + 1234
+			parsed, err := FileFromBytes(f.Bytes())
+			So(err, ShouldBeNil)
+			So(parsed.Size, ShouldEqual, 1234)
+			f.Size = 0x7FFFFFFF00000000
+			parsed, err = FileFromBytes(f.Bytes())
+			So(err, ShouldBeNil)
+			So(parsed.Size, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestMergeFile(t *testing.T) {
+	Convey("Merge", t, func() {
+		a := defaultGenerator.NewFake()
+		a.Static = false
+		a.Type = UnknownImage
+		b := a
+		b.LastUsage = a.LastUsage + 100
+		b.Size = a.Size - 1
+		b.Width = a.Width + 1
+		b.Height = a.Height - 1
+		b.Static = true
+		b.Type = PNG
+		merged := MergeFile(a, b)
+		So(merged, ShouldResemble, MergeFile(b, a))
+		So(merged.Hash, ShouldEqual, a.Hash)
+		So(merged.LastUsage, ShouldEqual, b.LastUsage)
+		So(merged.Size, ShouldEqual, a.Size)
+		So(merged.Width, ShouldEqual, b.Width)
+		So(merged.Height, ShouldEqual, a.Height)
+		So(merged.Static, ShouldBeTrue)
+		So(merged.Type, ShouldEqual, PNG)
+		Convey("Both types known", func() {
+			a.Type = GIF
+			b.Type = JPG
+			So(MergeFile(a, b).Type, ShouldEqual, JPG)
+			So(MergeFile(b, a).Type, ShouldEqual, JPG)
+		})
+		Convey("Different hashes", func() {
+			b.Hash[0] = a.Hash[0] + 1
+			c, d := a, b
+			if a.Hash[0] == 255 {
+				c, d = b, a
+			}
+			So(MergeFile(c, d), ShouldResemble, c)
+			So(MergeFile(d, c), ShouldResemble, c)
+		})
+	})
+}
+
+func TestCompareFiles(t *testing.T) {
+	Convey("Compare", t, func() {
+		a := defaultGenerator.NewFake()
+		b := a
+		So(CompareFiles(a, b), ShouldEqual, 0)
+		So(CompareByUsage(a, b), ShouldEqual, 0)
+		So(CompareBySize(a, b), ShouldEqual, 0)
+		a.Hash[0], b.Hash[0] = 1, 2
+		a.LastUsage, b.LastUsage = 200, 100
+		a.Size, b.Size = 10, 20
+		So(CompareFiles(a, b), ShouldEqual, -1)
+		So(CompareFiles(b, a), ShouldEqual, 1)
+		So(CompareByUsage(a, b), ShouldEqual, 1)
+		So(CompareByUsage(b, a), ShouldEqual, -1)
+		So(CompareBySize(a, b), ShouldEqual, -1)
+		So(CompareBySize(b, a), ShouldEqual, 1)
+		Convey("Sort", func() {
+			files := make([]File, 32)
+			for i := range files {
+				files[i] = defaultGenerator.NewFake()
+			}
+			sort.Slice(files, func(i, j int) bool {
+				return CompareFiles(files[i], files[j]) < 0
+			})
+			for i := 1; i < len(files); i++ {
+				So(CompareFiles(files[i-1], files[i]), ShouldBeLessThan, 1)
+			}
+		})
+		Convey("Sort interface", func() {
+			files := []File{
+				{Hash: [HashSize]byte{3}, LastUsage: 100},
+				{Hash: [HashSize]byte{1}, LastUsage: 300},
+				{Hash: [HashSize]byte{2}, LastUsage: 100},
+				{Hash: [HashSize]byte{4}, LastUsage: 50},
+			}
+			byHash := append(FilesByHash(nil), files...)
+			sort.Sort(byHash)
+			So([]File(byHash), ShouldResemble, []File{files[1], files[2], files[0], files[3]})
+			byUsage := append(FilesByLastUsage(nil), files...)
+			sort.Sort(byUsage)
+			// tie of 100 is broken by hash
+			So([]File(byUsage), ShouldResemble, []File{files[3], files[2], files[0], files[1]})
+		})
+		Convey("Tie break", func() {
+			b.LastUsage, b.Size, b.Type = a.LastUsage, a.Size, a.Type
+			So(CompareByUsage(a, b), ShouldEqual, -1)
+			So(CompareBySize(b, a), ShouldEqual, 1)
+			So(CompareByType(a, b), ShouldEqual, -1)
+			b.Type = a.Type + 1
+			So(CompareByType(b, a), ShouldEqual, 1)
+		})
+		Convey("Deterministic", func() {
+			// inventory with a lot of equal sizes, usages and types
+			inventory := make([]File, 200)
+			for i := range inventory {
+				f := defaultGenerator.NewFake()
+				f.Size = int64(i % 3)
+				f.LastUsage = int64(i % 5)
+				f.Type = FileType(i % int(UnknownImage))
+				inventory[i] = f
+			}
+			sorted := func(seed int64, cmp func(a, b File) int) []byte {
+				files := make([]File, len(inventory))
+				copy(files, inventory)
+				r := mrand.New(mrand.NewSource(seed))
+				r.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+				sort.Slice(files, func(i, j int) bool { return cmp(files[i], files[j]) < 0 })
+				var out []byte
+				for _, f := range files {
+					out = append(out, f.Bytes()...)
+				}
+				return out
+			}
+			for _, cmp := range []func(a, b File) int{CompareFiles, CompareByUsage, CompareBySize, CompareByType} {
+				// same node twice and other node with different initial order
+				So(bytes.Equal(sorted(1, cmp), sorted(1, cmp)), ShouldBeTrue)
+				So(bytes.Equal(sorted(1, cmp), sorted(2, cmp)), ShouldBeTrue)
+			}
+		})
+	})
+}
+
+func TestFileClone(t *testing.T) {
+	Convey("Clone", t, func() {
+		f := defaultGenerator.NewFake()
+		original := f.Hash
+		clone := f.Clone()
+		So(clone.Identical(f), ShouldBeTrue)
+		clone.Hash[0]++
+		clone.Use()
+		So(f.Hash, ShouldEqual, original)
+		Convey("Copy from", func() {
+			var dst File
+			dst.CopyFrom(f)
+			So(dst.Identical(f), ShouldBeTrue)
+			dst.Hash[1]++
+			So(f.Hash, ShouldEqual, original)
+		})
+	})
+}
+
+func TestFileEqual(t *testing.T) {
+	Convey("Equal", t, func() {
+		a := defaultGenerator.NewFake()
+		b := a
+		So(a.Equal(b), ShouldBeTrue)
+		So(a.Identical(b), ShouldBeTrue)
+		b.LastUsage++
+		So(a.Equal(b), ShouldBeTrue)
+		So(a.Identical(b), ShouldBeFalse)
+		So(a.LastUsage, ShouldEqual, b.LastUsage-1)
+		for _, change := range []func(f *File){
+			func(f *File) { f.Hash[HashSize-1]++ },
+			func(f *File) { f.Type ^= 1 },
+			func(f *File) { f.Size++ },
+			func(f *File) { f.Width++ },
+			func(f *File) { f.Height++ },
+			func(f *File) { f.Static = !f.Static },
+		} {
+			c := a
+			change(&c)
+			So(a.Equal(c), ShouldBeFalse)
+			So(a.Identical(c), ShouldBeFalse)
+		}
+	})
+}
+
+func TestFileContentKey(t *testing.T) {
+	Convey("Content key", t, func() {
+		a := defaultGenerator.NewFake()
+		a.Type = JPG
+		b := a
+		b.LastUsage++
+		b.Static = !a.Static
+		So(a.ContentKey(), ShouldEqual, b.ContentKey())
+		b.Type = PNG
+		So(a.ContentKey(), ShouldNotEqual, b.ContentKey())
+		keys := map[ContentKey]File{a.ContentKey(): a, b.ContentKey(): b}
+		So(keys, ShouldHaveLength, 2)
+		So(keys[a.ContentKey()].Type, ShouldEqual, JPG)
+	})
+}
+
+// fileLayoutBytes is sum of serialized field sizes, in order of File.Bytes
+const fileLayoutBytes = HashSize + 1 + 1 + sizeBytes + 2*resolutionBytes + usageBytes
+
+// compile-time assertions that FileBytes agrees with layout:
+// one of array lengths is negative if they differ
+var (
+	_ [FileBytes - fileLayoutBytes]byte
+	_ [fileLayoutBytes - FileBytes]byte
+)
+
+func TestFileBytesLayout(t *testing.T) {
+	Convey("Layout", t, func() {
+		So(FileSerializedSize(), ShouldEqual, FileBytes)
+		f := File{Type: 0xAB, Static: true, Size: 0x01020304, Height: 0x0506, Width: 0x0708, LastUsage: 0x090A0B0C0D0E0F10}
+		f.Hash[0], f.Hash[HashSize-1] = 0x11, 0x12
+		b := f.Bytes()
+		So(b, ShouldHaveLength, FileSerializedSize())
+		cursor := 0
+		So(b[cursor], ShouldEqual, 0x11)
+		So(b[cursor+HashSize-1], ShouldEqual, 0x12)
+		cursor += HashSize
+		So(b[cursor], ShouldEqual, 0xAB)
+		cursor++
+		So(b[cursor], ShouldEqual, 255)
+		cursor++
+		So(binary.LittleEndian.Uint32(b[cursor:cursor+sizeBytes]), ShouldEqual, 0x01020304)
+		cursor += sizeBytes
+		So(binary.LittleEndian.Uint16(b[cursor:cursor+resolutionBytes]), ShouldEqual, 0x0506)
+		cursor += resolutionBytes
+		So(binary.LittleEndian.Uint16(b[cursor:cursor+resolutionBytes]), ShouldEqual, 0x0708)
+		cursor += resolutionBytes
+		// only lowest 5 bytes of LastUsage
+		So(b[cursor:cursor+usageBytes], ShouldResemble, []byte{0x10, 0x0F, 0x0E, 0x0D, 0x0C})
+		cursor += usageBytes
+		So(cursor, ShouldEqual, FileBytes)
+	})
+}
+
+func TestFileAppendBytes(t *testing.T) {
+	Convey("AppendBytes", t, func() {
+		g := defaultGenerator
+		var buf []byte
+		for i := 0; i < 10; i++ {
+			f := g.NewFake()
+			f.Static = i%2 == 0
+			So(f.AppendBytes(nil), ShouldResemble, f.Bytes())
+			buf = f.AppendBytes(buf)
+			So(buf[len(buf)-FileBytes:], ShouldResemble, f.Bytes())
+		}
+		So(buf, ShouldHaveLength, 10*FileBytes)
+		Convey("Reused buffer", func() {
+			// garbage in spare capacity is overwritten
+			scratch := bytes.Repeat([]byte{0xFF}, FileBytes+3)[:3]
+			f := File{Size: 1}
+			out := f.AppendBytes(scratch)
+			So(out[:3], ShouldResemble, []byte{0xFF, 0xFF, 0xFF})
+			So(out[3:], ShouldResemble, f.Bytes())
+			So(&out[0], ShouldEqual, &scratch[0])
+		})
+	})
+}
+
+// fileBytesV1 serializes file in previous layout with 8 byte LastUsage
+func fileBytesV1(f File) []byte {
+	b := f.Bytes()[:FileBytes-usageBytes]
+	var usage [usageBytesV1]byte
+	binary.LittleEndian.PutUint64(usage[:], uint64(f.LastUsage))
+	return append(b, usage[:]...)
+}
+
+func TestFileBytesVersions(t *testing.T) {
+	Convey("Layout versions", t, func() {
+		So(FileBytes, ShouldEqual, 35)
+		So(FileBytesV1, ShouldEqual, 38)
+		f := defaultGenerator.NewFake()
+		f.Static = true
+		for _, usage := range []int64{0, 1, 1474117323, 1 << 32, maxLastUsage} {
+			f.LastUsage = usage
+			Convey(fmt.Sprintf("Usage %d", usage), func() {
+				Convey("Current", func() {
+					b := f.Bytes()
+					So(b, ShouldHaveLength, FileBytes)
+					parsed, err := FileFromBytes(b)
+					So(err, ShouldBeNil)
+					So(parsed, ShouldResemble, f)
+				})
+				Convey("Previous", func() {
+					b := fileBytesV1(f)
+					So(b, ShouldHaveLength, FileBytesV1)
+					parsed, err := FileFromBytes(b)
+					So(err, ShouldBeNil)
+					So(parsed, ShouldResemble, f)
+					Convey("Migration", func() {
+						migrated, err := FileFromBytes(parsed.Bytes())
+						So(err, ShouldBeNil)
+						So(migrated, ShouldResemble, f)
+						So(parsed.Bytes(), ShouldResemble, b[:FileBytes])
+					})
+				})
+			})
+		}
+		Convey("Usage out of range", func() {
+			f.LastUsage = maxLastUsage + 1
+			parsed, err := FileFromBytes(fileBytesV1(f))
+			So(err, ShouldBeNil)
+			So(parsed.LastUsage, ShouldEqual, maxLastUsage+1)
+			// higher bytes are dropped in current layout
+			parsed, err = FileFromBytes(f.Bytes())
+			So(err, ShouldBeNil)
+			So(parsed.LastUsage, ShouldEqual, 0)
+			f.LastUsage = -1
+			parsed, err = FileFromBytes(f.Bytes())
+			So(err, ShouldBeNil)
+			So(parsed.LastUsage, ShouldEqual, maxLastUsage)
+		})
+		Convey("Bad length", func() {
+			for _, length := range []int{0, FileBytes - 1, FileBytes + 1, FileBytesV1 - 1, FileBytesV1 + 1} {
+				_, err := FileFromBytes(make([]byte, length))
+				So(err, ShouldEqual, ErrFileInconsistent)
+			}
+		})
+		Convey("Size check", func() {
+			f.Size = FileMaximumSize + 1
+			_, err := FileFromBytes(fileBytesV1(f))
+			So(err, ShouldEqual, ErrSizeOverflow)
+		})
+	})
+}
+
+func TestFileSignedToken(t *testing.T) {
+	Convey("Signed token", t, func() {
+		f := File{Size: 12345, Width: 1920, Height: 1080, Type: PNG}
+		So(f.SetHash("070b45ae488fb1967aaf618561a7d6ba4d28a1c9"), ShouldBeNil)
+		now := time.Date(2015, 10, 16, 12, 0, 0, 0, time.UTC)
+		zone := time.FixedZone("UTC+3", 3*60*60)
+		token := f.SignedToken("key", now.Add(time.Hour).In(zone))
+		So(token, ShouldStartWith, "20151016T130000Z-")
+		So(VerifyToken(token, f, "key", now), ShouldBeNil)
+		So(VerifyToken(token, f, "key", now.Add(time.Hour)), ShouldEqual, ErrTokenExpired)
+		So(VerifyToken(token, f, "key2", now), ShouldEqual, ErrTokenInvalid)
+		other := f
+		other.Size++
+		So(VerifyToken(token, other, "key", now), ShouldEqual, ErrTokenInvalid)
+		Convey("Tampered", func() {
+			tampered := "20151016T140000Z" + token[len("20151016T130000Z"):]
+			So(VerifyToken(tampered, f, "key", now.Add(time.Hour)), ShouldEqual, ErrTokenInvalid)
+			for _, bad := range []string{"", "20151016T130000Z", "20151016T130000Z-!!!", "kek-" + token[len("20151016T130000Z-"):]} {
+				So(VerifyToken(bad, f, "key", now), ShouldEqual, ErrTokenInvalid)
+			}
+		})
+	})
+}
+
+func TestHashDistance(t *testing.T) {
+	Convey("Hash distance", t, func() {
+		var a, b [HashSize]byte
+		So(HashDistance(a, b), ShouldEqual, 0)
+		b[0] = 0x81
+		b[HashSize-1] = 0x0F
+		So(HashDistance(a, b), ShouldEqual, 6)
+		So(HashDistance(b, a), ShouldEqual, 6)
+		for i := range b {
+			b[i] = 0xFF
+		}
+		So(HashDistance(a, b), ShouldEqual, HashSize*8)
+		So(HashDistance(b, b), ShouldEqual, 0)
+	})
+}
+
+func BenchmarkHashDistance(b *testing.B) {
+	x := defaultGenerator.NewFake()
+	y := defaultGenerator.NewFake()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		HashDistance(x.Hash, y.Hash)
+	}
+}
+
+func TestFileAt(t *testing.T) {
+	Convey("File at offset", t, func() {
+		a := defaultGenerator.NewFake()
+		b := defaultGenerator.NewFake()
+		data := []byte("prefix")
+		data = append(data, a.Bytes()...)
+		data = append(data, "data"...)
+		data = append(data, b.Bytes()...)
+		r := bytes.NewReader(data)
+		f, err := FileAt(r, int64(len("prefix")))
+		So(err, ShouldBeNil)
+		So(f, ShouldResemble, a)
+		f, err = FileAt(r, int64(len(data)-FileBytes))
+		So(err, ShouldBeNil)
+		So(f, ShouldResemble, b)
+		Convey("Short read", func() {
+			_, err := FileAt(r, int64(len(data)-FileBytes+1))
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			_, err = FileAt(r, int64(len(data)))
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+		})
+	})
+}
+
+func TestFileWithResolution(t *testing.T) {
+	Convey("With resolution", t, func() {
+		f := defaultGenerator.NewFake()
+		g, err := f.WithResolution(640, 480)
+		So(err, ShouldBeNil)
+		So(g.Width, ShouldEqual, 640)
+		So(g.Height, ShouldEqual, 480)
+		So(g.Hash, ShouldEqual, f.Hash)
+		So(f.Width, ShouldNotEqual, 640)
+		g, err = f.WithResolution(1<<16-1, 0)
+		So(err, ShouldBeNil)
+		decoded, err := FileFromBytes(g.Bytes())
+		So(err, ShouldBeNil)
+		So(decoded.Width, ShouldEqual, 1<<16-1)
+		for _, r := range [][2]int{{-1, 10}, {10, -1}, {1 << 16, 10}, {10, 1 << 16}} {
+			g, err = f.WithResolution(r[0], r[1])
+			So(err, ShouldEqual, ErrBadResolution)
+			So(g, ShouldResemble, f)
+		}
+	})
+}
+
+func FuzzFileFromBytes(f *testing.F) {
+	g := FileGenerator{SizeMax: 10000, ResolutionMax: 500}
+	for i := 0; i < 4; i++ {
+		f.Add(g.NewFake().Bytes())
+	}
+	f.Add(make([]byte, FileBytes))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		file, err := FileFromBytes(data)
+		if err != nil {
+			return
+		}
+		// previous layout can have LastUsage that does not fit current one
+		file.LastUsage &= maxLastUsage
+		parsed, err := FileFromBytes(file.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != file {
+			t.Errorf("%+v != %+v", parsed, file)
+		}
+	})
+}
+
+func FuzzFileFromID(f *testing.F) {
+	g := FileGenerator{SizeMax: 10000, ResolutionMax: 500}
+	for i := 0; i < 4; i++ {
+		f.Add(g.NewFake().String())
+	}
+	f.Add("")
+	f.Add("----")
+	f.Fuzz(func(t *testing.T, id string) {
+		file, err := FileFromID(id)
+		if err != nil {
+			return
+		}
+		parsed, err := FileFromID(file.String())
+		if err != nil {
+			t.Fatalf("%q parsed, but %q failed: %v", id, file, err)
+		}
+		parsed.LastUsage = file.LastUsage
+		if parsed != file {
+			t.Errorf("%+v != %+v", parsed, file)
+		}
+	})
+}
+
+func TestStaticRangeSymmetry(t *testing.T) {
+	Convey("Static range", t, func() {
+		Convey("Symmetric", func() {
+			for i := 0; i < 1<<16; i++ {
+				r := StaticRange{byte(i >> 8), byte(i)}
+				parsed, err := ParseStaticRange(r.String())
+				if err != nil || parsed != r {
+					So(parsed, ShouldEqual, r)
+					So(err, ShouldBeNil)
+				}
+			}
+		})
+		Convey("Error handling", func() {
+			for s, expected := range map[string]error{
+				"070":   ErrStaticRangeLength,
+				"070b1": ErrStaticRangeLength,
+				"":      ErrStaticRangeLength,
+				"07xb":  ErrStaticRangeHex,
+				"zzzz":  ErrStaticRangeHex,
+			} {
+				r, err := ParseStaticRange(s)
+				So(r, ShouldEqual, StaticRange{})
+				So(errors.Is(err, expected), ShouldBeTrue)
+				So(err, ShouldNotEqual, io.ErrUnexpectedEOF)
+				rangeErr, ok := err.(StaticRangeError)
+				So(ok, ShouldBeTrue)
+				So(rangeErr.Range, ShouldEqual, s)
+			}
+		})
+	})
+}
+
+func TestParseErrorSentinels(t *testing.T) {
+	Convey("Sentinel errors", t, func() {
+		for _, s := range []string{"070", "zzzz", ""} {
+			_, err := ParseStaticRange(s)
+			So(errors.Is(err, ErrInvalidStaticRange), ShouldBeTrue)
+			So(errors.Is(err, ErrInvalidFileID), ShouldBeFalse)
+		}
+		_, err := ParseStaticRanges("070b;07b")
+		So(errors.Is(err, ErrInvalidStaticRange), ShouldBeTrue)
+		var ranges StaticRanges
+		So(errors.Is(json.Unmarshal([]byte(`["zzzz"]`), &ranges), ErrInvalidStaticRange), ShouldBeTrue)
+
+		for _, id := range []string{
+			"one-two-three",
+			"070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png-extra",
+			"",
+		} {
+			_, err := FileFromID(id)
+			So(errors.Is(err, ErrInvalidFileID), ShouldBeTrue)
+			So(err, ShouldNotEqual, io.ErrUnexpectedEOF)
+			_, err = FileFromIDStrict(id)
+			So(errors.Is(err, ErrInvalidFileID), ShouldBeTrue)
+		}
+		_, err = FileFromIDStrict("070b45ae488fb1967aaf618561a7d6ba4d28a1c9-?-1920-1080-png")
+		So(errors.Is(err, ErrInvalidFileID), ShouldBeTrue)
+		_, err = FileFromIDStrict("070b45-12345-1920-1080-png")
+		So(errors.Is(err, ErrInvalidFileID), ShouldBeTrue)
+		So(errors.Is(err, ErrHashBadLength), ShouldBeTrue)
+		So(errors.Is(io.ErrUnexpectedEOF, ErrInvalidFileID), ShouldBeFalse)
+	})
+}
+
+func FuzzParseStaticRange(f *testing.F) {
+	f.Add("a1b2")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, s string) {
+		r, err := ParseStaticRange(s)
+		if err != nil {
+			return
+		}
+		if !strings.EqualFold(r.String(), s) {
+			t.Errorf("%q != %q", r, s)
+		}
+	})
+}
+
+func TestFileValidate(t *testing.T) {
+	Convey("Validate", t, func() {
+		f, err := FileFromID("070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png")
+		So(err, ShouldBeNil)
+		So(f.Validate(), ShouldBeNil)
+		Convey("Fields", func() {
+			invalid := map[string]func(f *File){
+				"hash":       func(f *File) { f.Hash = [HashSize]byte{} },
+				"type":       func(f *File) { f.Type = UnknownImage },
+				"size":       func(f *File) { f.Size = FileMaximumSize + 1 },
+				"width":      func(f *File) { f.Width = 0 },
+				"height":     func(f *File) { f.Height = maxResolution + 1 },
+				"last usage": func(f *File) { f.LastUsage = time.Now().Add(48 * time.Hour).Unix() },
+			}
+			for field, change := range invalid {
+				bad := f
+				change(&bad)
+				err := bad.Validate()
+				So(err, ShouldNotBeNil)
+				So(err.(FileIDError).Field, ShouldEqual, field)
+			}
+			f.Size = 0
+			So(f.Validate().(FileIDError).Err, ShouldEqual, ErrFileBadLength)
+			f.Size = FileMaximumSize
+			f.LastUsage = time.Now().Add(time.Hour).Unix()
+			So(f.Validate(), ShouldBeNil)
+		})
+		Convey("First failing field", func() {
+			So(File{}.Validate().(FileIDError).Field, ShouldEqual, "hash")
+		})
+		Convey("Strict parsing", func() {
+			_, err := FileFromIDStrict("070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-0-1080-png")
+			So(err, ShouldResemble, FileIDError{Field: "width", Err: ErrBadResolution})
+			_, err = FileFromID("070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-0-1080-png")
+			So(err, ShouldResemble, FileIDError{Field: "width", Err: ErrBadResolution})
+			_, err = FileFromNameSep("070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-0-1080-png", "-")
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestFileJSON(t *testing.T) {
+	Convey("JSON", t, func() {
+		f, err := FileFromID("070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png")
+		So(err, ShouldBeNil)
+		f.Static = true
+		f.LastUsage = 1474117323
+		golden, err := ioutil.ReadFile("test/file.json")
+		So(err, ShouldBeNil)
+		b, err := json.Marshal(f)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, string(bytes.TrimSpace(golden)))
+
+		var parsed File
+		So(json.Unmarshal(golden, &parsed), ShouldBeNil)
+		So(parsed, ShouldResemble, f)
+		Convey("Error handling", func() {
+			var parsed File
+			So(json.Unmarshal([]byte(`{"hash":"070b45","type":"png"}`), &parsed), ShouldEqual, ErrHashBadLength)
+			So(json.Unmarshal([]byte(`{"hash":"kek","type":"png"}`), &parsed), ShouldNotBeNil)
+			So(json.Unmarshal([]byte(`{"hash":"070b45ae488fb1967aaf618561a7d6ba4d28a1c9","type":"bmp"}`), &parsed), ShouldEqual, ErrFileTypeUnknown)
+			So(json.Unmarshal([]byte(`{"hash":1}`), &parsed), ShouldNotBeNil)
+			So(parsed, ShouldResemble, File{})
+		})
+	})
+}
+
+func TestStaticRangesJSON(t *testing.T) {
+	Convey("Static ranges JSON", t, func() {
+		ranges, err := ParseStaticRanges("ffff;070b;0000;a1b2")
+		So(err, ShouldBeNil)
+		golden, err := ioutil.ReadFile("test/static_ranges.json")
+		So(err, ShouldBeNil)
+		b, err := json.Marshal(ranges)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, string(bytes.TrimSpace(golden)))
+
+		var parsed StaticRanges
+		So(json.Unmarshal(golden, &parsed), ShouldBeNil)
+		So(parsed, ShouldResemble, ranges)
+		Convey("Empty", func() {
+			b, err := json.Marshal(StaticRanges{})
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "[]")
+			for _, data := range []string{"[]", "null"} {
+				var parsed StaticRanges
+				So(json.Unmarshal([]byte(data), &parsed), ShouldBeNil)
+				So(parsed, ShouldNotBeNil)
+				So(parsed.Count(), ShouldEqual, 0)
+			}
+		})
+		Convey("Error handling", func() {
+			var parsed StaticRanges
+			err := json.Unmarshal([]byte(`["070b","07b"]`), &parsed)
+			So(err, ShouldNotBeNil)
+			So(err.(StaticRangeError).Range, ShouldEqual, "07b")
+			So(json.Unmarshal([]byte(`{"070b":true}`), &parsed), ShouldNotBeNil)
+			So(parsed, ShouldBeNil)
+		})
+	})
+}
+
+func TestSyncStaticRanges(t *testing.T) {
+	Convey("Sync static ranges", t, func() {
+		f, err := FileFromID("070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png")
+		So(err, ShouldBeNil)
+		var s SyncStaticRanges
+		So(s.Contains(f), ShouldBeFalse)
+		So(s.Count(), ShouldEqual, 0)
+		s.Remove(f.Range())
+		s.Add(f.Range())
+		So(s.Contains(f), ShouldBeTrue)
+		So(s.String(), ShouldEqual, "070b")
+		snapshot := s.Snapshot()
+		s.Remove(f.Range())
+		So(s.Contains(f), ShouldBeFalse)
+		So(snapshot.Contains(f), ShouldBeTrue)
+		s.Set(snapshot)
+		So(s.Count(), ShouldEqual, 1)
+		So(NewSyncStaticRanges(snapshot).Contains(f), ShouldBeTrue)
+
+		Convey("Concurrent", func() {
+			var (
+				wg   sync.WaitGroup
+				done = make(chan struct{})
+			)
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+							s.Contains(f)
+							s.Count()
+						}
+					}
+				}()
+			}
+			for i := 0; i < 1000; i++ {
+				r := StaticRange{byte(i), byte(i >> 8)}
+				s.Add(r)
+				s.Remove(r)
+				_ = s.String()
+			}
+			close(done)
+			wg.Wait()
+			So(s.Count(), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestParseFileTypeStrict(t *testing.T) {
+	Convey("Strict file type parsing", t, func() {
+		for name, expected := range map[string]FileType{"JPEG": JPG, "jpg": JPG, "png": PNG, "Gif": GIF} {
+			f, err := ParseFileTypeStrict(name)
+			So(err, ShouldBeNil)
+			So(f, ShouldEqual, expected)
+		}
+		for _, name := range []string{"", "bmp", "unknown"} {
+			f, err := ParseFileTypeStrict(name)
+			So(err, ShouldEqual, ErrFileTypeUnknown)
+			So(f, ShouldEqual, UnknownImage)
+			So(ParseFileType(name), ShouldEqual, UnknownImage)
+		}
+	})
+}
+
+func TestFileTypeValues(t *testing.T) {
+	Convey("File type values", t, func() {
+		// values are persisted, so they should never change
+		So(JPG, ShouldEqual, 0)
+		So(PNG, ShouldEqual, 1)
+		So(GIF, ShouldEqual, 2)
+		So(WEBP, ShouldEqual, 3)
+		So(AVIF, ShouldEqual, 4)
+		for _, name := range FileTypes {
+			f := ParseFileType(name)
+			So(f, ShouldBeLessThan, UnknownImage)
+			So(f.String(), ShouldEqual, name)
+			So(File{Type: f}.ContentType(), ShouldEqual, ContentTypes[f])
+		}
+		So(ParseFileType("WEBP"), ShouldEqual, WEBP)
+		So(File{Type: AVIF}.ContentType(), ShouldEqual, "image/avif")
+		So(File{Type: WEBP}.ContentType(), ShouldEqual, "image/webp")
+	})
+}
+
+func TestDetectFileType(t *testing.T) {
+	Convey("Detect file type", t, func() {
+		gopher, err := os.Open("test/gopher.jpg")
+		So(err, ShouldBeNil)
+		defer gopher.Close()
+		ft, err := DetectFileType(gopher)
+		So(err, ShouldBeNil)
+		So(ft, ShouldEqual, JPG)
+		offset, err := gopher.Seek(0, io.SeekCurrent)
+		So(err, ShouldBeNil)
+		So(offset, ShouldEqual, fileTypeHeaderSize)
+
+		examples := map[string]FileType{
+			"\x89PNG\r\n\x1a\n":            PNG,
+			"GIF89a":                       GIF,
+			"RIFF\x24\x00\x00\x00WEBPVP8 ": WEBP,
+			"BM":                           UnknownImage,
+			"":                             UnknownImage,
+		}
+		for data, expected := range examples {
+			ft, err := DetectFileType(strings.NewReader(data))
+			So(err, ShouldBeNil)
+			So(ft, ShouldEqual, expected)
+		}
+		Convey("Read error", func() {
+			errRead := errors.New("read failed")
+			_, err := DetectFileType(iotest.ErrReader(errRead))
+			So(err, ShouldEqual, errRead)
+		})
+		Convey("Verify", func() {
+			f := File{Type: PNG}
+			So(f.VerifyType(strings.NewReader("\x89PNG\r\n\x1a\n")), ShouldBeNil)
+			So(f.VerifyType(strings.NewReader("GIF89a")), ShouldEqual, ErrFileTypeMismatch)
+			So(f.VerifyType(strings.NewReader("")), ShouldEqual, ErrFileTypeMismatch)
 		})
 	})
 }
@@ -84,7 +84,6 @@ func main() {
 		log.Println("iterating...")
 		var count int
 
-		fileBytes := len(g.NewFake().Bytes())
 		for _, f := range files {
 			if f.Static {
 				count++
@@ -124,7 +123,7 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		var buffer = make([]byte, fileBytes)
+		var buffer = make([]byte, hath.FileBytes)
 		var f hath.File
 		start = time.Now()
 		for {
@@ -0,0 +1,18 @@
+package hath
+
+import "net/http"
+
+const headerETag = "ETag"
+
+// ETag returns strong entity tag of file, that is quoted hex hash,
+// as file content never changes for same hash
+func (f File) ETag() string {
+	return `"` + f.HexID() + `"`
+}
+
+// WriteHTTPHeaders sets Content-Type, Content-Length and ETag headers for serving file
+func (f File) WriteHTTPHeaders(h http.Header) {
+	h.Set(headerContentType, f.ContentType())
+	h.Set(headerContentLength, sInt64(f.Size))
+	h.Set(headerETag, f.ETag())
+}
@@ -0,0 +1,23 @@
+package hath
+
+import (
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileWriteHTTPHeaders(t *testing.T) {
+	Convey("HTTP headers", t, func() {
+		f, err := FileFromID("070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png")
+		So(err, ShouldBeNil)
+		h := make(http.Header)
+		h.Set(headerContentType, "text/plain")
+		f.WriteHTTPHeaders(h)
+		So(h, ShouldResemble, http.Header{
+			"Content-Type":   {"image/png"},
+			"Content-Length": {"12345"},
+			"Etag":           {`"070b45ae488fb1967aaf618561a7d6ba4d28a1c9"`},
+		})
+	})
+}
@@ -0,0 +1,220 @@
+package hath
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"image"
+	// registering decoders for built-in types
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SkippedFile is file that was not imported by ImportDir
+type SkippedFile struct {
+	Path string
+	Err  error
+}
+
+// ImportWarnings is returned by ImportDir if some files were skipped
+type ImportWarnings []SkippedFile
+
+func (w ImportWarnings) Error() string {
+	elems := make([]string, len(w))
+	for i, s := range w {
+		elems[i] = fmt.Sprintf("%s: %v", s.Path, s.Err)
+	}
+	return fmt.Sprintf("%d files skipped: %s", len(w), strings.Join(elems, "; "))
+}
+
+// ImportDir walks root and adds every image with arbitrary name to cache as hath file,
+// detecting type by magic bytes and dimensions by decoding image config.
+// Files that are not images that can be decoded or are larger than FileMaximumSize are skipped,
+// and returned error is ImportWarnings listing them, while imported files are still returned.
+// Other errors stop import.
+func ImportDir(root string, cache DirectCache) ([]File, error) {
+	var (
+		files    []File
+		warnings ImportWarnings
+	)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, skip, err := importFile(p, cache)
+		if err != nil {
+			return err
+		}
+		if skip != nil {
+			log.Println("import:", "skipping", p, skip)
+			warnings = append(warnings, SkippedFile{Path: p, Err: skip})
+			return nil
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return files, err
+	}
+	if len(warnings) > 0 {
+		return files, warnings
+	}
+	return files, nil
+}
+
+// byteCounter is io.Writer that counts written bytes
+type byteCounter int64
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	*c += byteCounter(len(b))
+	return len(b), nil
+}
+
+// NewFileFromReader reads file data from r in one pass without buffering, computing hash and size,
+// detecting type by magic bytes and dimensions by decoding image config, and sets LastUsage to now.
+// Returns ErrFileTypeUnknown if type is not detected, ErrFileTooLarge if data is larger than
+// FileMaximumSize, or error of image.DecodeConfig if type has no registered decoder.
+func NewFileFromReader(r io.Reader) (File, error) {
+	var (
+		f      File
+		size   byteCounter
+		hasher = sha1.New()
+		tee    = io.TeeReader(io.LimitReader(r, FileMaximumSize+1), io.MultiWriter(hasher, &size))
+		header [fileTypeHeaderSize]byte
+	)
+	n, err := io.ReadFull(tee, header[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return f, err
+	}
+	if f.Type = detectFileType(header[:n]); f.Type == UnknownImage {
+		return f, ErrFileTypeUnknown
+	}
+	cfg, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(header[:n]), tee))
+	if err != nil {
+		return f, err
+	}
+	f.Width, f.Height = cfg.Width, cfg.Height
+	if _, err = io.Copy(ioutil.Discard, tee); err != nil {
+		return f, err
+	}
+	if size > FileMaximumSize {
+		return f, ErrFileTooLarge
+	}
+	f.Size = int64(size)
+	copy(f.Hash[:], hasher.Sum(nil))
+	f.Use()
+	return f, nil
+}
+
+// importFile reads file on path p and adds it to cache,
+// returning reason in skip if file is not suitable for import
+func importFile(p string, cache DirectCache) (f File, skip error, err error) {
+	r, err := os.Open(p)
+	if err != nil {
+		return f, nil, err
+	}
+	defer r.Close()
+	info, err := r.Stat()
+	if err != nil {
+		return f, nil, err
+	}
+	if info.Size() > FileMaximumSize {
+		return f, ErrFileTooLarge, nil
+	}
+	f.Size = info.Size()
+
+	if f.Type, err = DetectFileType(r); err != nil {
+		return f, nil, err
+	}
+	if f.Type == UnknownImage {
+		return f, ErrFileTypeUnknown, nil
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return f, nil, err
+	}
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return f, err, nil
+	}
+	f.Width, f.Height = cfg.Width, cfg.Height
+
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return f, nil, err
+	}
+	hasher := sha1.New()
+	if _, err = io.Copy(hasher, r); err != nil {
+		return f, nil, err
+	}
+	copy(f.Hash[:], hasher.Sum(nil))
+
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return f, nil, err
+	}
+	f.Use()
+	return f, nil, cache.Add(f, r)
+}
+
+// fileListComment starts comment line in file list
+const fileListComment = "#"
+
+// FileListLine is line of file list that failed to parse
+type FileListLine struct {
+	Line int
+	Err  error
+}
+
+// FileListErrors is returned by ParseFileList if some lines failed to parse
+type FileListErrors []FileListLine
+
+func (e FileListErrors) Error() string {
+	elems := make([]string, len(e))
+	for i, l := range e {
+		elems[i] = fmt.Sprintf("line %d: %v", l.Line, l.Err)
+	}
+	return fmt.Sprintf("%d lines skipped: %s", len(e), strings.Join(elems, "; "))
+}
+
+// ParseFileList reads file list in text format of H@H client, that is one file id
+// (see FileFromID) per line, so existing caches can be migrated. Blank lines and lines
+// starting with # are skipped. Lines that fail to parse are skipped too, and returned
+// error is FileListErrors listing their numbers, starting from 1, while parsed files are
+// still returned. Read errors stop parsing.
+func ParseFileList(r io.Reader) ([]File, error) {
+	var (
+		files   []File
+		skipped FileListErrors
+		scanner = bufio.NewScanner(r)
+		line    int
+	)
+	for scanner.Scan() {
+		line++
+		id := strings.TrimSpace(scanner.Text())
+		if id == "" || strings.HasPrefix(id, fileListComment) {
+			continue
+		}
+		f, err := FileFromID(id)
+		if err != nil {
+			skipped = append(skipped, FileListLine{Line: line, Err: err})
+			continue
+		}
+		files = append(files, f)
+	}
+	if err := scanner.Err(); err != nil {
+		return files, err
+	}
+	if len(skipped) > 0 {
+		return files, skipped
+	}
+	return files, nil
+}
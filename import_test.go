@@ -0,0 +1,119 @@
+package hath
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestImportDir(t *testing.T) {
+	Convey("Import dir", t, func() {
+		dir, err := ioutil.TempDir("", randDirPrefix)
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		gopher, err := ioutil.ReadFile("test/gopher.jpg")
+		So(err, ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(dir, "some image.jpg"), gopher, 0666), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0666), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(dir, "broken.png"), []byte{0x89, 'P', 'N', 'G', 0, 0}, 0666), ShouldBeNil)
+		So(os.Mkdir(filepath.Join(dir, "sub"), 0777), ShouldBeNil)
+		out, err := os.Create(filepath.Join(dir, "sub", "pic"))
+		So(err, ShouldBeNil)
+		So(png.Encode(out, image.NewRGBA(image.Rect(0, 0, 30, 20))), ShouldBeNil)
+		So(out.Close(), ShouldBeNil)
+
+		cache := &MemStore{}
+		files, err := ImportDir(dir, cache)
+		warnings, ok := err.(ImportWarnings)
+		So(ok, ShouldBeTrue)
+		So(warnings, ShouldHaveLength, 2)
+		So(files, ShouldHaveLength, 2)
+		for _, f := range files {
+			So(cache.Check(f), ShouldBeNil)
+			if f.Type == JPG {
+				So(f.HexID(), ShouldEqual, "070b45ae488fb1967aaf618561a7d6ba4d28a1c9")
+				So(f.Size, ShouldEqual, len(gopher))
+			} else {
+				So(f.Type, ShouldEqual, PNG)
+				So(f.Width, ShouldEqual, 30)
+				So(f.Height, ShouldEqual, 20)
+			}
+		}
+		Convey("No warnings", func() {
+			So(os.Remove(filepath.Join(dir, "notes.txt")), ShouldBeNil)
+			So(os.Remove(filepath.Join(dir, "broken.png")), ShouldBeNil)
+			files, err := ImportDir(dir, &MemStore{})
+			So(err, ShouldBeNil)
+			So(files, ShouldHaveLength, 2)
+		})
+	})
+}
+
+func TestNewFileFromReader(t *testing.T) {
+	Convey("New file from reader", t, func() {
+		gopher, err := ioutil.ReadFile("test/gopher.jpg")
+		So(err, ShouldBeNil)
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(gopher))
+		So(err, ShouldBeNil)
+		f, err := NewFileFromReader(bytes.NewReader(gopher))
+		So(err, ShouldBeNil)
+		So(f.Hash, ShouldEqual, sha1.Sum(gopher))
+		So(f.Type, ShouldEqual, JPG)
+		So(f.Size, ShouldEqual, len(gopher))
+		So(f.Width, ShouldEqual, cfg.Width)
+		So(f.Height, ShouldEqual, cfg.Height)
+		So(f.LastUsage, ShouldBeGreaterThan, 0)
+		Convey("Unknown type", func() {
+			_, err := NewFileFromReader(strings.NewReader("not an image"))
+			So(err, ShouldEqual, ErrFileTypeUnknown)
+		})
+		Convey("Too large", func() {
+			padding := io.LimitReader(zeroReader{}, FileMaximumSize)
+			_, err := NewFileFromReader(io.MultiReader(bytes.NewReader(gopher), padding))
+			So(err, ShouldEqual, ErrFileTooLarge)
+		})
+	})
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestParseFileList(t *testing.T) {
+	Convey("Parse file list", t, func() {
+		r, err := os.Open("test/fileindex.txt")
+		So(err, ShouldBeNil)
+		defer r.Close()
+		files, err := ParseFileList(r)
+		So(err, ShouldResemble, FileListErrors{{Line: 5, Err: ErrInvalidFileID}})
+		So(err.Error(), ShouldEqual, "1 lines skipped: line 5: "+ErrInvalidFileID.Error())
+		So(files, ShouldHaveLength, 3)
+		for i, id := range []string{
+			"070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png",
+			"a1b2c3d4e5f60718293a4b5c6d7e8f9012345678-999-640-480-jpg",
+			"ffffffffffffffffffffffffffffffffffffffff-1-1-1-gif",
+		} {
+			So(files[i].String(), ShouldEqual, id)
+		}
+		Convey("Valid", func() {
+			files, err := ParseFileList(strings.NewReader("# only comment\n\n" + files[0].String() + "\r\n"))
+			So(err, ShouldBeNil)
+			So(files, ShouldHaveLength, 1)
+		})
+	})
+}
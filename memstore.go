@@ -0,0 +1,217 @@
+package hath
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// ErrCacheFull is returned by MemStore.Add when file can't fit
+// even after eviction of all non-static files
+var ErrCacheFull = errors.New("hath => cache is full")
+
+type memEntry struct {
+	file File
+	data []byte
+}
+
+// MemStore is DirectCache that holds files in memory, limiting
+// total size by MaxBytes and evicting least recently used (by LastUsage)
+// files when full. Static files are never evicted.
+// Zero value is ready to use and has no limit.
+// MemStore is safe for concurrent use.
+type MemStore struct {
+	// MaxBytes is maximum total size of files, zero means no limit
+	MaxBytes int64
+	// Validators are run on Add before file is stored
+	Validators Validators
+
+	mu      sync.Mutex
+	size    int64
+	entries map[[HashSize]byte]*memEntry
+}
+
+// Size returns total size of stored files
+func (m *MemStore) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
+
+// Metrics returns count and total size of stored files
+func (m *MemStore) Metrics() CacheMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return CacheMetrics{Files: int64(len(m.entries)), Bytes: m.size}
+}
+
+// Get returns reader for file data and updates LastUsage of file
+// if file does not exist, it will return ErrFileNotFound
+func (m *MemStore) Get(file File) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[file.Hash]
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	e.file.Use()
+	return ioutil.NopCloser(bytes.NewReader(e.data)), nil
+}
+
+// HasAll returns slice that has true for every file of files that exists in store, in same order,
+// matching files by ContentKey (see BatchChecker)
+func (m *MemStore) HasAll(files []File) ([]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]bool, len(files))
+	for i, f := range files {
+		e, ok := m.entries[f.Hash]
+		result[i] = ok && e.file.ContentKey() == f.ContentKey()
+	}
+	return result, nil
+}
+
+// Open returns seekable reader for file data
+func (m *MemStore) Open(file File) (ReadSeekCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[file.Hash]
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	e.file.Use()
+	return bufferedFile{bytes.NewReader(e.data)}, nil
+}
+
+// Add saves file to memory, evicting least recently used files if needed.
+// File is rejected with ErrSizeMismatch or ErrHashMismatch if data does not match it
+// (see ValidateContent), or with first error of Validators.
+func (m *MemStore) Add(file File, r io.Reader) error {
+	// checking size and hash while reading
+	var buf bytes.Buffer
+	if err := ValidateContent(io.TeeReader(r, &buf), file); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if err := m.Validators.Validate(file, data); err != nil {
+		return err
+	}
+	if file.LastUsage == 0 {
+		file.LastUsage = time.Now().Unix()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries == nil {
+		m.entries = make(map[[HashSize]byte]*memEntry)
+	}
+	// checking before any change, so on failure previous copy of file
+	// and other files are kept
+	if !m.fits(file.Hash, file.Size) {
+		return ErrCacheFull
+	}
+	m.remove(file.Hash)
+	m.entries[file.Hash] = &memEntry{file: file, data: data}
+	m.size += file.Size
+	m.evict(file.Hash)
+	return nil
+}
+
+// fits returns true if file with provided hash and size can be stored
+// after replacing its previous copy and evicting all non-static files
+func (m *MemStore) fits(hash [HashSize]byte, size int64) bool {
+	if m.MaxBytes <= 0 {
+		return true
+	}
+	total := m.size + size
+	for h, e := range m.entries {
+		if h == hash || !e.file.Static {
+			total -= e.file.Size
+		}
+	}
+	return total <= m.MaxBytes
+}
+
+// evict removes least recently used non-static files except
+// one with provided hash until total size fits MaxBytes,
+// see fits for checking that it is possible
+func (m *MemStore) evict(keep [HashSize]byte) {
+	for m.MaxBytes > 0 && m.size > m.MaxBytes {
+		var victim *memEntry
+		for hash, e := range m.entries {
+			if e.file.Static || hash == keep {
+				continue
+			}
+			if victim == nil || e.file.LastUsage < victim.file.LastUsage {
+				victim = e
+			}
+		}
+		if victim == nil {
+			return
+		}
+		m.remove(victim.file.Hash)
+	}
+}
+
+// remove deletes entry, returning false if it does not exist
+func (m *MemStore) remove(hash [HashSize]byte) bool {
+	e, ok := m.entries[hash]
+	if !ok {
+		return false
+	}
+	m.size -= e.file.Size
+	delete(m.entries, hash)
+	return true
+}
+
+// Remove removes file from memory
+func (m *MemStore) Remove(file File) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.remove(file.Hash) {
+		return ErrFileNotFound
+	}
+	return nil
+}
+
+// RemoveBatch removes files from memory, skipping not existing ones
+func (m *MemStore) RemoveBatch(files []File) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range files {
+		m.remove(f.Hash)
+	}
+	return nil
+}
+
+// Check performs sha1 hash checking on file
+// returns nil if all ok
+func (m *MemStore) Check(file File) error {
+	m.mu.Lock()
+	e, ok := m.entries[file.Hash]
+	m.mu.Unlock()
+	if !ok {
+		return ErrFileNotFound
+	}
+	return file.Verify(e.data)
+}
+
+// Scan sends all stored files to results
+func (m *MemStore) Scan(results chan File, progress chan Progress) error {
+	defer close(progress)
+	m.mu.Lock()
+	files := make([]File, 0, len(m.entries))
+	for _, e := range m.entries {
+		files = append(files, e.file)
+	}
+	m.mu.Unlock()
+	p := Progress{Total: len(files)}
+	for n, f := range files {
+		p.Current = n
+		progress <- p
+		results <- f
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package hath
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func memStoreFile(size int, lastUsage int64, static bool) (File, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+	f := File{Size: int64(size), LastUsage: lastUsage, Static: static, Type: JPG}
+	f.Hash = sha1.Sum(data)
+	return f, data
+}
+
+func TestMemStore(t *testing.T) {
+	Convey("MemStore", t, func() {
+		m := &MemStore{MaxBytes: 300}
+		old, oldData := memStoreFile(100, 10, false)
+		static, staticData := memStoreFile(100, 5, true)
+		recent, recentData := memStoreFile(100, 20, false)
+		So(m.Add(old, bytes.NewReader(oldData)), ShouldBeNil)
+		So(m.Add(static, bytes.NewReader(staticData)), ShouldBeNil)
+		So(m.Add(recent, bytes.NewReader(recentData)), ShouldBeNil)
+		So(m.Size(), ShouldEqual, 300)
+
+		Convey("Get", func() {
+			r, err := m.Get(old)
+			So(err, ShouldBeNil)
+			data, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(r.Close(), ShouldBeNil)
+			So(bytes.Equal(data, oldData), ShouldBeTrue)
+			So(m.Check(old), ShouldBeNil)
+			Convey("Updates usage", func() {
+				f, data := memStoreFile(100, 30, false)
+				So(m.Add(f, bytes.NewReader(data)), ShouldBeNil)
+				_, err := m.Get(old)
+				So(err, ShouldBeNil)
+				_, err = m.Get(recent)
+				So(err, ShouldEqual, ErrFileNotFound)
+			})
+		})
+		Convey("Evict", func() {
+			f, data := memStoreFile(150, 30, false)
+			So(m.Add(f, bytes.NewReader(data)), ShouldBeNil)
+			So(m.Size(), ShouldEqual, 250)
+			_, err := m.Get(old)
+			So(err, ShouldEqual, ErrFileNotFound)
+			_, err = m.Get(recent)
+			So(err, ShouldEqual, ErrFileNotFound)
+			_, err = m.Get(static)
+			So(err, ShouldBeNil)
+			_, err = m.Get(f)
+			So(err, ShouldBeNil)
+		})
+		Convey("Full", func() {
+			f, data := memStoreFile(250, 30, false)
+			So(m.Add(f, bytes.NewReader(data)), ShouldEqual, ErrCacheFull)
+			_, err := m.Get(f)
+			So(err, ShouldEqual, ErrFileNotFound)
+			So(m.Size(), ShouldBeLessThan, 301)
+		})
+		Convey("Full keeps previous copy", func() {
+			// even after evicting recent file, old one does not fit
+			m.MaxBytes = 150
+			So(m.Add(old, bytes.NewReader(oldData)), ShouldEqual, ErrCacheFull)
+			So(m.Size(), ShouldEqual, 300)
+			r, err := m.Get(old)
+			So(err, ShouldBeNil)
+			got, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(got, oldData), ShouldBeTrue)
+			_, err = m.Get(recent)
+			So(err, ShouldBeNil)
+		})
+		Convey("Bad length", func() {
+			f, data := memStoreFile(10, 30, false)
+			f.Size = 11
+			So(m.Add(f, bytes.NewReader(data)), ShouldEqual, ErrSizeMismatch)
+			f.Size = 10
+			f.Hash[0]++
+			So(m.Add(f, bytes.NewReader(data)), ShouldEqual, ErrHashMismatch)
+		})
+		Convey("Remove", func() {
+			So(m.Remove(old), ShouldBeNil)
+			So(m.Remove(old), ShouldEqual, ErrFileNotFound)
+			So(m.RemoveBatch([]File{old, recent}), ShouldBeNil)
+			So(m.Size(), ShouldEqual, 100)
+			So(m.Check(old), ShouldEqual, ErrFileNotFound)
+		})
+		Convey("Scan", func() {
+			files := make(chan File, 3)
+			progress := make(chan Progress, 3)
+			So(m.Scan(files, progress), ShouldBeNil)
+			close(files)
+			found := 0
+			for range files {
+				found++
+			}
+			So(found, ShouldEqual, 3)
+		})
+		Convey("Concurrent", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					f, data := memStoreFile(10+i, int64(i), false)
+					m.Add(f, bytes.NewReader(data))
+					m.Get(f)
+					m.Get(old)
+				}(i)
+			}
+			wg.Wait()
+			So(m.Size(), ShouldBeLessThan, 301)
+		})
+	})
+}
@@ -362,8 +362,7 @@ func (s *DefaultServer) proxy(c *gin.Context, f File, token string, galleryID, p
 		buff := f.Buffer()
 		w := io.MultiWriter(buff, c.Writer)
 		// proxying data without buffering for speed-up
-		c.Writer.Header().Add(headerContentLength, sInt64(f.Size))
-		c.Writer.Header().Add(headerContentType, f.ContentType())
+		f.WriteHTTPHeaders(c.Writer.Header())
 
 		n, err := io.CopyN(w, rc, f.Size)
 		if err != nil || n != f.Size {
@@ -490,8 +489,7 @@ func (s *DefaultServer) handleImage(c *gin.Context) {
 		c.String(http.StatusBadRequest, "400: bad file id")
 		return
 	}
-	expectedKeyStamp := f.KeyStamp(s.cfg.Key, timestamp)
-	if expectedKeyStamp != keyStamp && !s.cfg.DontCheckSHA1 {
+	if !s.cfg.DontCheckSHA1 && !f.VerifyKeyStamp(s.cfg.Key, timestamp, keyStamp) {
 		c.String(http.StatusForbidden, "403: bad keystamp")
 		return
 	}
@@ -504,7 +502,7 @@ func (s *DefaultServer) handleImage(c *gin.Context) {
 	}
 	if !s.cfg.Settings.StaticRanges.Contains(f) {
 		log.Println("server:", "not found", f)
-		c.String(http.StatusNotFound, "404: not found")
+		s.notFound(c)
 		return
 	}
 
@@ -515,12 +513,22 @@ func (s *DefaultServer) handleImage(c *gin.Context) {
 	}
 	token, ok := tokens[f.String()]
 	if !ok || filename == onDemandFilename {
-		c.String(http.StatusNotFound, "404: not found")
+		s.notFound(c)
 		return
 	}
 	s.proxy(c, f, token, 1, 1, onDemandFilename)
 }
 
+// notFound responds on cache miss with cfg.NotFoundHandler,
+// falling back to plain 404 if handler is not set
+func (s *DefaultServer) notFound(c *gin.Context) {
+	if s.cfg.NotFoundHandler != nil {
+		s.cfg.NotFoundHandler.ServeHTTP(c.Writer, c.Request)
+		return
+	}
+	c.String(http.StatusNotFound, "404: not found")
+}
+
 func getSHA1(sep string, args []string) string {
 	hasher := sha1.New()
 	toHash := strings.Join(args, sep)
@@ -1203,6 +1211,9 @@ type ServerConfig struct {
 	MaxDownloadAttemps  int
 	Settings            Settings
 	Debug               bool
+	// NotFoundHandler is invoked on cache miss instead of plain 404,
+	// i.e. to serve placeholder image
+	NotFoundHandler http.Handler
 }
 
 // PopulateDefaults of the config
@@ -158,6 +158,56 @@ func TestServer(t *testing.T) {
 			// 	So(f2.String(), ShouldEqual, f.String())
 			// })
 		})
+		Convey("GET with not found handler", func() {
+			// upstream fails, so file is never fetched
+			responce := new(http.Response)
+			responce.StatusCode = http.StatusNotFound
+			responce.Body = ioutil.NopCloser(bytes.NewBufferString("404"))
+			*tc = testClient{nil, responce, ErrClientUnexpectedResponse}
+			f := g.NewFake()
+			get := func(ks string) *http.Response {
+				args := make(Args)
+				args[argsKeystamp] = fmt.Sprintf("%d-%s", time.Now().Unix(), ks)
+				uPath := fmt.Sprintf("/h/%s/%s/test.png", f, args)
+				link := &url.URL{Host: u.Host, Scheme: "http", Path: uPath}
+				res, err := http.Get(link.String())
+				So(err, ShouldBeNil)
+				return res
+			}
+			placeholder := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(headerContentType, "image/png")
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprint(w, "placeholder")
+			})
+			defer func() {
+				server.cfg.NotFoundHandler = nil
+			}()
+
+			Convey("Placeholder", func() {
+				server.cfg.NotFoundHandler = placeholder
+				res := get(f.KeyStamp(credentials.Key, time.Now().Unix()))
+				defer res.Body.Close()
+				So(res.StatusCode, ShouldEqual, http.StatusOK)
+				So(res.Header.Get(headerContentType), ShouldEqual, "image/png")
+				body, err := ioutil.ReadAll(res.Body)
+				So(err, ShouldBeNil)
+				So(string(body), ShouldEqual, "placeholder")
+			})
+			Convey("Bad keystamp", func() {
+				server.cfg.NotFoundHandler = placeholder
+				res := get("badstamp00")
+				defer res.Body.Close()
+				So(res.StatusCode, ShouldEqual, http.StatusForbidden)
+				body, err := ioutil.ReadAll(res.Body)
+				So(err, ShouldBeNil)
+				So(string(body), ShouldNotEqual, "placeholder")
+			})
+			Convey("Default", func() {
+				res := get(f.KeyStamp(credentials.Key, time.Now().Unix()))
+				defer res.Body.Close()
+				So(res.StatusCode, ShouldEqual, http.StatusNotFound)
+			})
+		})
 	})
 }
 
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// minFreeRegion is minimum size of region that is kept in free list, smaller
+// leftovers can't fit even header and are left in allocated region as waste
+const minFreeRegion = HeaderStructureSize
+
+// sizeClasses is count of free list buckets, region of size s is in bucket bits.Len64(s)
+const sizeClasses = 64
+
+// region is continuous part of bulk
+type region struct {
+	offset Offset
+	size   int64
+}
+
+// Allocator allocates regions of bulk, reusing freed regions or appending them to its end.
+// Freed regions are coalesced with adjacent free regions and binned by size class, that is
+// power of two, and allocation prefers exact or next larger freed region, splitting leftover
+// back to free list. Allocator is safe for concurrent use.
+type Allocator struct {
+	mu  sync.Mutex
+	end Offset
+	// free are buckets of free regions by size class, that can have stale
+	// entries for regions that were coalesced, checked against starts
+	free [sizeClasses][]region
+	// starts are sizes of free regions by their offsets
+	starts map[Offset]int64
+	// ends are offsets of free regions by their ends
+	ends map[Offset]Offset
+	// padded are sizes of allocated regions that are bigger than requested
+	padded map[Offset]int64
+	// freeBytes is total size of regions in free list
+	freeBytes int64
+	// wasted is total size of leftovers in allocated regions
+	wasted int64
+}
+
+// AllocatorMetrics is snapshot of allocator fragmentation
+type AllocatorMetrics struct {
+	// End is offset of bulk end
+	End int64 `json:"end"`
+	// Free is total size of freed regions, available for reuse
+	Free int64 `json:"free"`
+	// Regions is count of freed regions
+	Regions int `json:"regions"`
+	// Wasted is total size of unused leftovers in allocated regions, that is internal fragmentation
+	Wasted int64 `json:"wasted"`
+}
+
+// Fragmentation returns part of bulk that is not used by data, from 0 to 1
+func (m AllocatorMetrics) Fragmentation() float64 {
+	if m.End == 0 {
+		return 0
+	}
+	return float64(m.Free+m.Wasted) / float64(m.End)
+}
+
+// NewAllocator returns Allocator that starts allocating from end,
+// that is usually current size of bulk
+func NewAllocator(end Offset) *Allocator {
+	return &Allocator{
+		end:    end,
+		starts: make(map[Offset]int64),
+		ends:   make(map[Offset]Offset),
+		padded: make(map[Offset]int64),
+	}
+}
+
+// sizeClass returns free list bucket for region size
+func sizeClass(size int64) int {
+	return bits.Len64(uint64(size)) - 1
+}
+
+// Alloc returns offset of new region with provided size
+func (a *Allocator) Alloc(size int64) Offset {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if size > 0 {
+		if r, ok := a.takeFree(size); ok {
+			return r
+		}
+	}
+	offset := a.end
+	a.end += Offset(size)
+	return offset
+}
+
+// takeFree removes fitting region of smallest size class from free list and returns
+// its offset, putting leftover back to free list
+func (a *Allocator) takeFree(size int64) (Offset, bool) {
+	for class := sizeClass(size); class < sizeClasses; class++ {
+		bucket := a.free[class]
+		for j := 0; j < len(bucket); j++ {
+			r := bucket[j]
+			stale := a.starts[r.offset] != r.size
+			// only bucket of requested size class can have smaller regions
+			if !stale && r.size < size {
+				continue
+			}
+			bucket[j] = bucket[len(bucket)-1]
+			bucket = bucket[:len(bucket)-1]
+			a.free[class] = bucket
+			if stale {
+				j--
+				continue
+			}
+			a.removeFree(r)
+			if leftover := r.size - size; leftover >= minFreeRegion {
+				a.putFree(region{offset: r.offset + Offset(size), size: leftover})
+			} else if leftover > 0 {
+				a.padded[r.offset] = r.size
+				a.wasted += leftover
+			}
+			return r.offset, true
+		}
+	}
+	return 0, false
+}
+
+// removeFree removes region from free list, leaving stale entry in bucket
+func (a *Allocator) removeFree(r region) {
+	delete(a.starts, r.offset)
+	delete(a.ends, r.offset+Offset(r.size))
+	a.freeBytes -= r.size
+}
+
+// putFree adds region to free list, coalescing it with adjacent free regions,
+// or returns it to the end of bulk if it is last region
+func (a *Allocator) putFree(r region) {
+	if start, ok := a.ends[r.offset]; ok {
+		prev := region{offset: start, size: a.starts[start]}
+		a.removeFree(prev)
+		r = region{offset: prev.offset, size: prev.size + r.size}
+	}
+	if size, ok := a.starts[r.offset+Offset(r.size)]; ok {
+		a.removeFree(region{offset: r.offset + Offset(r.size), size: size})
+		r.size += size
+	}
+	if r.offset+Offset(r.size) == a.end {
+		a.end = r.offset
+		return
+	}
+	class := sizeClass(r.size)
+	a.free[class] = append(a.free[class], r)
+	a.starts[r.offset] = r.size
+	a.ends[r.offset+Offset(r.size)] = r.offset
+	a.freeBytes += r.size
+}
+
+// Free returns region to allocator. Region is returned to the end of bulk if it is last one,
+// otherwise it is put to free list and is reused by next allocations.
+func (a *Allocator) Free(offset Offset, size int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if padded, ok := a.padded[offset]; ok {
+		delete(a.padded, offset)
+		a.wasted -= padded - size
+		size = padded
+	}
+	if size <= 0 {
+		return
+	}
+	a.putFree(region{offset: offset, size: size})
+}
+
+// End returns offset of bulk end, that is first not allocated byte
+func (a *Allocator) End() Offset {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.end
+}
+
+// Metrics returns allocator fragmentation metrics
+func (a *Allocator) Metrics() AllocatorMetrics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return AllocatorMetrics{
+		End:     int64(a.end),
+		Free:    a.freeBytes,
+		Regions: len(a.starts),
+		Wasted:  a.wasted,
+	}
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestAllocator(t *testing.T) {
+	a := NewAllocator(100)
+	first := a.Alloc(1000)
+	second := a.Alloc(500)
+	third := a.Alloc(2000)
+	if first != 100 || second != 1100 || third != 1600 {
+		t.Fatalf("unexpected offsets %d %d %d", first, second, third)
+	}
+
+	// last region is returned to end
+	a.Free(third, 2000)
+	if a.End() != 1600 {
+		t.Errorf("end %d != %d", a.End(), 1600)
+	}
+	third = a.Alloc(2000)
+
+	// other regions are reused with splitting
+	a.Free(first, 1000)
+	if m := a.Metrics(); m.Free != 1000 || m.Regions != 1 {
+		t.Errorf("unexpected %+v", m)
+	}
+	if offset := a.Alloc(600); offset != first {
+		t.Errorf("%d != %d", offset, first)
+	}
+	if offset := a.Alloc(400); offset != first+600 {
+		t.Errorf("%d != %d", offset, first+600)
+	}
+	if m := a.Metrics(); m.Free != 0 || m.Regions != 0 || m.End != 3600 {
+		t.Errorf("unexpected %+v", m)
+	}
+
+	// small leftovers are wasted until region is freed
+	a.Free(second, 500)
+	if offset := a.Alloc(500 - minFreeRegion + 1); offset != second {
+		t.Errorf("%d != %d", offset, second)
+	}
+	m := a.Metrics()
+	if m.Wasted != minFreeRegion-1 || m.Free != 0 {
+		t.Errorf("unexpected %+v", m)
+	}
+	if m.Fragmentation() <= 0 {
+		t.Errorf("fragmentation %f", m.Fragmentation())
+	}
+	a.Free(second, 500-minFreeRegion+1)
+	if m := a.Metrics(); m.Wasted != 0 || m.Free != 500 {
+		t.Errorf("unexpected %+v", m)
+	}
+
+	// too large regions are allocated at end
+	if offset := a.Alloc(10000); offset != 3600 {
+		t.Errorf("%d != %d", offset, 3600)
+	}
+}
+
+func TestAllocator_Coalesce(t *testing.T) {
+	a := NewAllocator(0)
+	offsets := make([]Offset, 5)
+	for i := range offsets {
+		offsets[i] = a.Alloc(100)
+	}
+	a.Free(offsets[1], 100)
+	a.Free(offsets[3], 100)
+	a.Free(offsets[2], 100)
+	if m := a.Metrics(); m.Free != 300 || m.Regions != 1 {
+		t.Errorf("unexpected %+v", m)
+	}
+	if offset := a.Alloc(300); offset != offsets[1] {
+		t.Errorf("%d != %d", offset, offsets[1])
+	}
+	a.Free(offsets[1], 300)
+
+	// freeing last region returns all adjacent free regions to end
+	a.Free(offsets[4], 100)
+	if m := a.Metrics(); m.Free != 0 || m.Regions != 0 || m.End != 100 {
+		t.Errorf("unexpected %+v", m)
+	}
+}
+
+func BenchmarkAllocator_Fragmentation(b *testing.B) {
+	const (
+		live    = 1000
+		sizeMin = 1024
+		sizeMax = 1024 * 1024
+	)
+	type allocation struct {
+		offset Offset
+		size   int64
+	}
+	r := rand.New(rand.NewSource(1))
+	a := NewAllocator(0)
+	allocations := make([]allocation, live)
+	for i := range allocations {
+		size := sizeMin + r.Int63n(sizeMax-sizeMin)
+		allocations[i] = allocation{a.Alloc(size), size}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := r.Intn(live)
+		a.Free(allocations[j].offset, allocations[j].size)
+		size := sizeMin + r.Int63n(sizeMax-sizeMin)
+		allocations[j] = allocation{a.Alloc(size), size}
+	}
+	b.StopTimer()
+	b.ReportMetric(a.Metrics().Fragmentation()*100, "frag%")
+}
@@ -2,7 +2,12 @@ package storage
 
 import (
 	"errors"
+	"io"
 	"os"
+	"sync"
+	"time"
+
+	"cydev.ru/hath"
 )
 
 var (
@@ -27,7 +32,7 @@ func (b Bulk) ReadHeader(l Link, buf []byte) (Header, error) {
 	var h Header
 	h.ID = l.ID
 	h.Offset = l.Offset
-	_, err := b.Backend.ReadAt(buf[:LinkStructureSize], l.Offset)
+	_, err := b.Backend.ReadAt(buf[:LinkStructureSize], int64(l.Offset))
 	if err != nil {
 		return h, err
 	}
@@ -41,7 +46,7 @@ func (b Bulk) ReadHeader(l Link, buf []byte) (Header, error) {
 // ReadData reads h.Size bytes into buffer from f.DataOffset.
 func (b Bulk) ReadData(h Header, buf []byte) error {
 	buf = buf[:h.Size]
-	_, err := b.Backend.ReadAt(buf, h.DataOffset())
+	_, err := b.Backend.ReadAt(buf, int64(h.DataOffset()))
 	return err
 }
 
@@ -52,12 +57,92 @@ func (b Bulk) Write(h Header, data []byte) error {
 	copy(tmp, data[:HeaderStructureSize])
 	// serializing header to data, preventing heap escape
 	h.Put(data[:HeaderStructureSize])
-	_, err := b.Backend.WriteAt(data[:HeaderStructureSize], h.Offset)
+	_, err := b.Backend.WriteAt(data[:HeaderStructureSize], int64(h.Offset))
 	// loading back first bytes
 	copy(data[:HeaderStructureSize], tmp)
 	if err != nil {
 		return err
 	}
-	_, err = b.Backend.WriteAt(data, h.DataOffset())
+	_, err = b.Backend.WriteAt(data, int64(h.DataOffset()))
 	return err
 }
+
+// BulkWriter appends files to the end of bulk, prepending them with Header, and returns
+// Links that can be written to Index. BulkWriter is safe for concurrent use.
+type BulkWriter struct {
+	Backend BulkBackend
+
+	mu  sync.Mutex
+	end Offset
+}
+
+// NewBulkWriter returns BulkWriter that appends to the end of backend
+func NewBulkWriter(backend BulkBackend) (*BulkWriter, error) {
+	info, err := backend.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &BulkWriter{Backend: backend, end: Offset(info.Size())}, nil
+}
+
+// End returns offset of bulk end, where next file will be appended
+func (w *BulkWriter) End() Offset {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.end
+}
+
+// Append writes Header and data of file with provided id to the end of bulk
+// and returns Link to it. Space is reserved before write, so on error region
+// is left unused and is reclaimed only by vacuum.
+func (w *BulkWriter) Append(id FileID, data []byte) (Link, error) {
+	h := Header{
+		ID:        id,
+		Size:      int64(len(data)),
+		Timestamp: time.Now().Unix(),
+	}
+	w.mu.Lock()
+	h.Offset = w.end
+	w.end += HeaderStructureSize + Offset(h.Size)
+	w.mu.Unlock()
+
+	buf := NewHeaderBuffer()
+	h.Put(buf)
+	if _, err := w.Backend.WriteAt(buf, int64(h.Offset)); err != nil {
+		return Link{}, err
+	}
+	if _, err := w.Backend.WriteAt(data, int64(h.DataOffset())); err != nil {
+		return Link{}, err
+	}
+	return Link{ID: h.ID, Offset: h.Offset}, nil
+}
+
+// BulkReader reads file data from bulk by Link
+type BulkReader struct {
+	Backend BulkBackend
+}
+
+// Read returns data of file f linked by l. Header is checked to have same ID as l and
+// same size as f, otherwise ErrIDMismatch or hath.ErrSizeMismatch is returned.
+// If bulk ends before data, io.ErrUnexpectedEOF is returned.
+func (r BulkReader) Read(l Link, f hath.File) ([]byte, error) {
+	h, err := Bulk{Backend: r.Backend}.ReadHeader(l, NewHeaderBuffer())
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.Size != f.Size {
+		return nil, hath.ErrSizeMismatch
+	}
+	data := f.Buffer().Bytes()[:f.Size]
+	n, err := r.Backend.ReadAt(data, int64(h.DataOffset()))
+	if n < len(data) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
@@ -2,9 +2,12 @@ package storage
 
 import (
 	"bytes"
+	"io"
 	"os"
 	"testing"
 	"time"
+
+	"cydev.ru/hath"
 )
 
 func TestBulk_Read(t *testing.T) {
@@ -96,7 +99,7 @@ func TestBulk_Write(t *testing.T) {
 func BenchmarkBulk_Read(b *testing.B) {
 	var backend memoryBackend
 	buf := make([]byte, LinkStructureSize)
-	var id int64
+	var id FileID
 	tmpLink := Link{
 		ID:     0,
 		Offset: 0,
@@ -110,7 +113,7 @@ func BenchmarkBulk_Read(b *testing.B) {
 	tmpHeader.Size = int64(len(data))
 	for id = 0; id < 10; id++ {
 		tmpLink.ID = id
-		tmpHeader.Offset = id * (tmpHeader.Size + LinkStructureSize)
+		tmpHeader.Offset = Offset(id) * Offset(tmpHeader.Size+LinkStructureSize)
 		tmpLink.Put(buf)
 		if _, err := backend.WriteAt(buf, 0); err != nil {
 			b.Fatal(err)
@@ -122,7 +125,7 @@ func BenchmarkBulk_Read(b *testing.B) {
 	bulk := Bulk{Backend: &backend}
 	l := Link{
 		ID:     3,
-		Offset: (tmpHeader.Size + LinkStructureSize) * 3,
+		Offset: Offset(tmpHeader.Size+LinkStructureSize) * 3,
 	}
 	hBuf := make([]byte, 0, tmpHeader.Size)
 	b.ResetTimer()
@@ -140,3 +143,104 @@ func BenchmarkBulk_Read(b *testing.B) {
 		}
 	}
 }
+
+func TestBulkWriter_Append(t *testing.T) {
+	backend := &MemoryBackend{}
+	w, err := NewBulkWriter(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := Index{Backend: &MemoryBackend{}}
+	blobs := [][]byte{
+		[]byte("first"),
+		bytes.Repeat([]byte("second blob, longer than header"), 4),
+	}
+	for id, blob := range blobs {
+		l, err := w.Append(FileID(id), blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = index.Write(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectedEnd := Offset(2*HeaderStructureSize + len(blobs[0]) + len(blobs[1]))
+	if w.End() != expectedEnd {
+		t.Errorf("end %d != %d", w.End(), expectedEnd)
+	}
+	bulk := Bulk{Backend: backend}
+	for id, blob := range blobs {
+		l, err := index.ReadBuff(FileID(id), NewLinkBuffer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := bulk.ReadHeader(l, NewHeaderBuffer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Size != int64(len(blob)) {
+			t.Errorf("size %d != %d", h.Size, len(blob))
+		}
+		buf := make([]byte, h.Size)
+		if err = bulk.ReadData(h, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, blob) {
+			t.Errorf("%q != %q", buf, blob)
+		}
+	}
+
+	// appending to existing bulk
+	w, err = NewBulkWriter(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.End() != expectedEnd {
+		t.Errorf("end %d != %d", w.End(), expectedEnd)
+	}
+}
+
+func TestBulkReader_Read(t *testing.T) {
+	backend := &MemoryBackend{}
+	w, err := NewBulkWriter(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := [][]byte{
+		[]byte("first"),
+		bytes.Repeat([]byte("second blob, longer than header"), 4),
+	}
+	links := make([]Link, len(blobs))
+	for id, blob := range blobs {
+		if links[id], err = w.Append(FileID(id), blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := BulkReader{Backend: backend}
+	for id, blob := range blobs {
+		data, err := r.Read(links[id], hath.File{Size: int64(len(blob))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, blob) {
+			t.Errorf("%q != %q", data, blob)
+		}
+	}
+	if _, err = r.Read(links[0], hath.File{Size: int64(len(blobs[0]) + 1)}); err != hath.ErrSizeMismatch {
+		t.Errorf("%v != %v", err, hath.ErrSizeMismatch)
+	}
+	if _, err = r.Read(Link{ID: 1, Offset: links[0].Offset}, hath.File{Size: int64(len(blobs[0]))}); err != ErrIDMismatch {
+		t.Errorf("%v != %v", err, ErrIDMismatch)
+	}
+	if _, err = r.Read(Link{ID: 2, Offset: w.End()}, hath.File{Size: 1}); err != io.ErrUnexpectedEOF {
+		t.Errorf("%v != %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// truncated data of last file
+	if err = backend.Truncate(int64(w.End()) - 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Read(links[1], hath.File{Size: int64(len(blobs[1]))}); err != io.ErrUnexpectedEOF {
+		t.Errorf("%v != %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CachedIndex is Index with LRU cache of links by id, so repeated lookups of
+// same ids don't hit backend. Links written or invalidated via CachedIndex are
+// updated or evicted in cache, so writes to underlying Index bypassing
+// CachedIndex are not visible until entry is evicted.
+//
+// CachedIndex is safe for concurrent use if Index.Backend is.
+type CachedIndex struct {
+	Index Index
+
+	mu    sync.Mutex
+	size  int
+	items map[FileID]*list.Element
+	order *list.List // front is most recently used
+	// gen is incremented on every write or invalidation, so link that was
+	// read from backend concurrently with them is not cached
+	gen uint64
+}
+
+// cacheEntry is element of CachedIndex LRU list. Key is stored separately
+// from link, because gaps in index are read as empty links with zero ID.
+type cacheEntry struct {
+	id   FileID
+	link Link
+}
+
+// NewCachedIndex returns CachedIndex over index that caches up to size links.
+// Non-positive size disables caching.
+func NewCachedIndex(index Index, size int) *CachedIndex {
+	return &CachedIndex{
+		Index: index,
+		size:  size,
+		items: make(map[FileID]*list.Element),
+		order: list.New(),
+	}
+}
+
+// Read returns Link with provided id from cache or from index on miss.
+// Only successfully read links are cached, and like Index.ReadBuff it
+// returns ErrLinkDeleted for tombstones.
+func (c *CachedIndex) Read(id FileID) (Link, error) {
+	c.mu.Lock()
+	if e, ok := c.items[id]; ok {
+		c.order.MoveToFront(e)
+		l := e.Value.(*cacheEntry).link
+		c.mu.Unlock()
+		if l.Deleted() {
+			return l, ErrLinkDeleted
+		}
+		return l, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	l, err := c.Index.ReadBuff(id, NewLinkBuffer())
+	if err != nil {
+		return l, err
+	}
+
+	c.mu.Lock()
+	if c.gen == gen {
+		c.put(id, l)
+	}
+	c.mu.Unlock()
+	return l, nil
+}
+
+// Write writes Link to index and updates it in cache.
+func (c *CachedIndex) Write(l Link) error {
+	err := c.Index.Write(l)
+	c.mu.Lock()
+	c.gen++
+	if err != nil {
+		// state of link in backend is unknown
+		c.remove(l.ID)
+	} else {
+		c.put(l.ID, l)
+	}
+	c.mu.Unlock()
+	return err
+}
+
+// Delete marks link as deleted in index and caches tombstone, see Index.Delete.
+func (c *CachedIndex) Delete(id FileID) error {
+	return c.Write(Link{ID: id, Offset: TombstoneOffset})
+}
+
+// Invalidate evicts link with provided id from cache, so next Read will hit index.
+func (c *CachedIndex) Invalidate(id FileID) {
+	c.mu.Lock()
+	c.gen++
+	c.remove(id)
+	c.mu.Unlock()
+}
+
+// Len returns count of cached links.
+func (c *CachedIndex) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// put adds or updates link in cache, evicting least recently used links
+// over size. Must be called with c.mu held.
+func (c *CachedIndex) put(id FileID, l Link) {
+	if c.size <= 0 {
+		return
+	}
+	if e, ok := c.items[id]; ok {
+		e.Value.(*cacheEntry).link = l
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[id] = c.order.PushFront(&cacheEntry{id: id, link: l})
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).id)
+	}
+}
+
+// remove evicts link from cache. Must be called with c.mu held.
+func (c *CachedIndex) remove(id FileID) {
+	if e, ok := c.items[id]; ok {
+		c.order.Remove(e)
+		delete(c.items, id)
+	}
+}
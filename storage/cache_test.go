@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingBackend is MemoryBackend that counts ReadAt calls
+type countingBackend struct {
+	MemoryBackend
+	reads int64
+}
+
+func (c *countingBackend) ReadAt(b []byte, off int64) (int, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.MemoryBackend.ReadAt(b, off)
+}
+
+func newCachedIndex(t testing.TB, size int, count FileID) (*CachedIndex, *countingBackend) {
+	backend := &countingBackend{}
+	index := Index{Backend: backend}
+	for id := FileID(0); id < count; id++ {
+		if err := index.Write(Link{ID: id, Offset: Offset(id) * 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewCachedIndex(index, size), backend
+}
+
+func TestCachedIndex(t *testing.T) {
+	c, backend := newCachedIndex(t, 2, 4)
+	read := func(id FileID, reads int64) {
+		l, err := c.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := (Link{ID: id, Offset: Offset(id) * 100}); l != expected {
+			t.Errorf("%v != %v", l, expected)
+		}
+		if r := atomic.LoadInt64(&backend.reads); r != reads {
+			t.Errorf("read %d: reads %d != %d", id, r, reads)
+		}
+	}
+	read(0, 1)
+	read(0, 1) // hit
+	read(1, 2)
+	read(0, 2) // hit, 0 is now most recently used
+	read(2, 3) // evicts 1
+	if c.Len() != 2 {
+		t.Errorf("len %d != 2", c.Len())
+	}
+	read(0, 3) // hit
+	read(1, 4) // miss, evicts 2
+	read(2, 5) // miss, evicts 0
+	read(1, 5) // hit
+
+	// write updates entry without reading
+	updated := Link{ID: 1, Offset: 1234}
+	if err := c.Write(updated); err != nil {
+		t.Fatal(err)
+	}
+	l, err := c.Read(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != updated {
+		t.Errorf("%v != %v", l, updated)
+	}
+	if r := atomic.LoadInt64(&backend.reads); r != 5 {
+		t.Errorf("reads %d != 5", r)
+	}
+
+	// invalidated entry is read from index again
+	c.Invalidate(1)
+	if _, err = c.Read(1); err != nil {
+		t.Fatal(err)
+	}
+	if r := atomic.LoadInt64(&backend.reads); r != 6 {
+		t.Errorf("reads %d != 6", r)
+	}
+
+	// failed write evicts entry
+	if err = c.Write(Link{ID: -1}); err != ErrNegativeID {
+		t.Errorf("%v != %v", err, ErrNegativeID)
+	}
+}
+
+func TestCachedIndex_Disabled(t *testing.T) {
+	c, backend := newCachedIndex(t, 0, 1)
+	for i := 0; i < 3; i++ {
+		if _, err := c.Read(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backend.reads != 3 {
+		t.Errorf("reads %d != 3", backend.reads)
+	}
+	if c.Len() != 0 {
+		t.Errorf("len %d != 0", c.Len())
+	}
+}
+
+func TestCachedIndex_Concurrent(t *testing.T) {
+	const count = 64
+	c, _ := newCachedIndex(t, count/4, count)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				id := FileID((i * (g + 1)) % count)
+				l, err := c.Read(id)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if l.ID != id {
+					t.Errorf("%v != %v", l.ID, id)
+					return
+				}
+				if i%10 == 0 {
+					c.Invalidate(id)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if c.Len() > count/4 {
+		t.Errorf("len %d > %d", c.Len(), count/4)
+	}
+}
+
+func BenchmarkCachedIndex_Read(b *testing.B) {
+	c, backend := newCachedIndex(b, 16, 16)
+	for id := FileID(0); id < 16; id++ {
+		if _, err := c.Read(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reads := atomic.LoadInt64(&backend.reads)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Read(FileID(i % 16)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if r := atomic.LoadInt64(&backend.reads); r != reads {
+		b.Errorf("cache hits resulted in %d backend reads", r-reads)
+	}
+}
+
+func TestCachedIndex_Delete(t *testing.T) {
+	c, backend := newCachedIndex(t, 4, 2)
+	if err := c.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(1); err != ErrLinkDeleted {
+		t.Errorf("%v != %v", err, ErrLinkDeleted)
+	}
+	if backend.reads != 0 {
+		t.Errorf("reads %d != 0", backend.reads)
+	}
+	c.Invalidate(1)
+	if _, err := c.Read(1); err != ErrLinkDeleted {
+		t.Errorf("%v != %v", err, ErrLinkDeleted)
+	}
+}
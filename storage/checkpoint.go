@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// CheckpointInterval is count of links in block that is covered by one checkpoint
+const CheckpointInterval = 1024
+
+// checkpointSize is size of one checkpoint in sidecar, that is crc32 of block
+const checkpointSize = crc32.Size
+
+var (
+	// ErrNoCheckpoints is returned when Index.Checkpoints is not set
+	ErrNoCheckpoints = errors.New("Index has no checkpoints backend")
+	// ErrIndexCorrupted is returned when index does not match checkpoint or has invalid link
+	ErrIndexCorrupted = errors.New("Index is corrupted")
+)
+
+// checkpointsCount returns count of recorded checkpoints and count of complete blocks in index
+func (i Index) checkpointsCount() (recorded, blocks int64, err error) {
+	if i.Checkpoints == nil {
+		return 0, 0, ErrNoCheckpoints
+	}
+	info, err := i.Checkpoints.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	recorded = info.Size() / checkpointSize
+	if info, err = i.Backend.Stat(); err != nil {
+		return 0, 0, err
+	}
+	links, _ := linksCount(info.Size())
+	blocks = links / CheckpointInterval
+	return recorded, blocks, nil
+}
+
+// readBlock reads links of block to b, that should have length of whole block
+func (i Index) readBlock(block int64, b []byte) error {
+	n, err := i.Backend.ReadAt(b, int64(getLinkOffset(FileID(block*CheckpointInterval))))
+	if err == io.EOF && n == len(b) {
+		return nil
+	}
+	return err
+}
+
+// Checkpoint records checksums for all complete blocks of index that have no checkpoint yet.
+// Checkpointed blocks are expected to rarely change, so Checkpoint should be called
+// after links are written, e.g. periodically or on shutdown, while rewrites of links in
+// checkpointed blocks, like Index.Delete, recompute checksum of their block.
+func (i Index) Checkpoint() error {
+	recorded, blocks, err := i.checkpointsCount()
+	if err != nil {
+		return err
+	}
+	b := make([]byte, LinkStructureSize*CheckpointInterval)
+	crc := make([]byte, checkpointSize)
+	for block := recorded; block < blocks; block++ {
+		if err := i.readBlock(block, b); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(b))
+		if _, err := i.Checkpoints.WriteAt(crc, block*checkpointSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateCheckpoint recomputes checksum of block with link id if block is
+// already checkpointed, so rewritten link does not fail validation.
+func (i Index) updateCheckpoint(id FileID) error {
+	if i.Checkpoints == nil {
+		return nil
+	}
+	info, err := i.Checkpoints.Stat()
+	if err != nil {
+		return err
+	}
+	block := int64(id) / CheckpointInterval
+	if block >= info.Size()/checkpointSize {
+		return nil
+	}
+	b := make([]byte, LinkStructureSize*CheckpointInterval)
+	if err = i.readBlock(block, b); err != nil {
+		return err
+	}
+	crc := make([]byte, checkpointSize)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(b))
+	_, err = i.Checkpoints.WriteAt(crc, block*checkpointSize)
+	return err
+}
+
+// ValidateTail checks blocks starting from checkpoint fromCheckpoint against
+// recorded checksums, and links after last checkpoint to have ID equal to its position
+// or to be never written. Blocks before fromCheckpoint are not read, so validation
+// of index that was checked before is proportional to count of recent writes.
+// Returns ErrIndexCorrupted on first mismatch of checkpoint or link position,
+// or ErrLinkCorrupt if checksum of link after last checkpoint does not match.
+func (i Index) ValidateTail(fromCheckpoint int64) error {
+	recorded, _, err := i.checkpointsCount()
+	if err != nil {
+		return err
+	}
+	b := make([]byte, LinkStructureSize*CheckpointInterval)
+	crc := make([]byte, checkpointSize)
+	for block := fromCheckpoint; block < recorded; block++ {
+		if _, err := i.Checkpoints.ReadAt(crc, block*checkpointSize); err != nil && err != io.EOF {
+			return err
+		}
+		if err := i.readBlock(block, b); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(crc) != crc32.ChecksumIEEE(b) {
+			return ErrIndexCorrupted
+		}
+	}
+
+	// validating links that are not covered by checkpoints
+	info, err := i.Backend.Stat()
+	if err != nil {
+		return err
+	}
+	if _, aligned := linksCount(info.Size()); !aligned {
+		return ErrIndexCorrupted
+	}
+	start := recorded * CheckpointInterval
+	if fromCheckpoint > recorded {
+		start = fromCheckpoint * CheckpointInterval
+	}
+	c := Cursor{index: i, id: FileID(start)}
+	empty := Link{}
+	for {
+		id := c.id
+		links, more := c.Next(CheckpointInterval)
+		for j, l := range links {
+			if l != empty && l.ID != id+FileID(j) {
+				return ErrIndexCorrupted
+			}
+		}
+		if !more {
+			return c.Err()
+		}
+	}
+}
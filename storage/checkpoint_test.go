@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestIndex_ValidateTail(t *testing.T) {
+	indexFile := tempFile(t)
+	defer clearTempFile(indexFile, t)
+	checkpointsFile := tempFile(t)
+	defer clearTempFile(checkpointsFile, t)
+	index := Index{Backend: indexFile, Checkpoints: checkpointsFile}
+
+	if err := (Index{Backend: indexFile}).ValidateTail(0); err != ErrNoCheckpoints {
+		t.Errorf("%v != %v", err, ErrNoCheckpoints)
+	}
+	buf := NewLinkBuffer()
+	count := FileID(CheckpointInterval*2 + CheckpointInterval/2)
+	for id := FileID(0); id < count; id++ {
+		if err := index.WriteBuff(Link{ID: id, Offset: Offset(id) * 100}, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := checkpointsFile.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 2*checkpointSize {
+		t.Errorf("checkpoints size %d != %d", info.Size(), 2*checkpointSize)
+	}
+	// checkpoint is idempotent
+	if err := index.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.ValidateTail(0); err != nil {
+		t.Error(err)
+	}
+
+	// corrupting first block bypassing index, as writes via index update checkpoints
+	Link{ID: 10, Offset: 1}.Put(buf)
+	if _, err := indexFile.WriteAt(buf, int64(getLinkOffset(10))); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.ValidateTail(0); err != ErrIndexCorrupted {
+		t.Errorf("%v != %v", err, ErrIndexCorrupted)
+	}
+	if err := index.ValidateTail(1); err != nil {
+		t.Error(err)
+	}
+
+	// corrupting tail that is not covered by checkpoints
+	Link{ID: 5, Offset: 1}.Put(buf)
+	if _, err := indexFile.WriteAt(buf, int64(getLinkOffset(count-1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.ValidateTail(2); err != ErrIndexCorrupted {
+		t.Errorf("%v != %v", err, ErrIndexCorrupted)
+	}
+}
+
+func TestIndex_DeleteCheckpointed(t *testing.T) {
+	index := Index{Backend: &MemoryBackend{}, Checkpoints: &MemoryBackend{}}
+	count := FileID(CheckpointInterval*2 + 10)
+	for id := FileID(0); id < count; id++ {
+		if err := index.Write(Link{ID: id, Offset: Offset(id) * 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.ValidateTail(0); err != nil {
+		t.Fatal(err)
+	}
+	// deleting in first and second checkpointed blocks and in tail
+	for _, id := range []FileID{5, CheckpointInterval + 1, count - 1} {
+		if err := index.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := index.ValidateTail(0); err != nil {
+			t.Errorf("after delete of %d: %v", id, err)
+		}
+	}
+	if m := index.Metrics(); !m.Valid || m.Tombstones != 3 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+	// rewrite of link is checkpointed too
+	if err := index.Write(Link{ID: 5, Offset: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.ValidateTail(0); err != nil {
+		t.Error(err)
+	}
+}
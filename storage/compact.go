@@ -0,0 +1,62 @@
+package storage
+
+import "errors"
+
+// ErrCompactNotEmpty is returned by Index.Compact if destination backend is not empty
+var ErrCompactNotEmpty = errors.New("Index compaction destination is not empty")
+
+// Compact writes header and dense copy of index to empty dst, dropping gaps, tombstones and links for
+// which remap returns false. Links are passed to remap in order of ID along with new ID, that is
+// ID of link in dst if it is kept, so caller can relocate files in bulk, writing their headers
+// with new ID (see Bulk.ReadHeader), record mapping of old ID to new one for external references,
+// and return link with new offset. Kept links get consecutive IDs starting from 0, and ID of link
+// returned by remap is ignored. Links are written to dst in pages, and compaction stops on first error.
+//
+// As IDs are changed, RemapOffsets can't be used to compare source index with dst,
+// offsets should be remapped by remap instead.
+//
+// Compact is not atomic: on error dst contains partially written index and must be discarded.
+// Caller must swap index backend with dst only after Compact returns without error, and source
+// index must not be modified during compaction.
+func (i Index) Compact(dst IndexBackend, remap func(old Link, id FileID) (Link, bool)) error {
+	info, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != 0 {
+		return ErrCompactNotEmpty
+	}
+	if err = (Index{Backend: dst}).writeHeader(); err != nil {
+		return err
+	}
+	var (
+		buf   = make([]byte, LinkStructureSize*iteratePageSize)
+		id    FileID
+		start FileID
+	)
+	flush := func() error {
+		if id == start {
+			return nil
+		}
+		_, err := dst.WriteAt(buf[:int64(id-start)*LinkStructureSize], int64(getLinkOffset(start)))
+		start = id
+		return err
+	}
+	err = i.IterateLive(func(old Link) error {
+		l, ok := remap(old, id)
+		if !ok {
+			return nil
+		}
+		l.ID = id
+		l.Put(buf[int64(id-start)*LinkStructureSize:])
+		id++
+		if id-start == iteratePageSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
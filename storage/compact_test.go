@@ -0,0 +1,74 @@
+package storage
+
+import "testing"
+
+func TestIndex_Compact(t *testing.T) {
+	const count = iteratePageSize + 100
+	src := Index{Backend: &MemoryBackend{}}
+	for id := FileID(0); id < count; id++ {
+		if id%7 == 3 {
+			// gap
+			continue
+		}
+		if err := src.Write(Link{ID: id, Offset: Offset(id) * 100}); err != nil {
+			t.Fatal(err)
+		}
+		if id%5 == 1 {
+			if err := src.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var (
+		expected []Link
+		ids      = make(map[FileID]FileID)
+	)
+	dst := &MemoryBackend{}
+	err := src.Compact(dst, func(old Link, id FileID) (Link, bool) {
+		if old.Deleted() || (old.ID%7 == 3 && old.ID != 0) {
+			t.Errorf("unexpected %v passed to remap", old)
+		}
+		if id != FileID(len(expected)) {
+			t.Errorf("new id %d != %d", id, len(expected))
+		}
+		if old.ID%11 == 0 {
+			// evicted
+			return Link{}, false
+		}
+		ids[old.ID] = id
+		l := Link{ID: 1 << 40, Offset: old.Offset / 2}
+		expected = append(expected, Link{ID: id, Offset: l.Offset})
+		return l, true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compacted := Index{Backend: dst}
+	if n, err := compacted.Count(); err != nil || n != int64(len(expected)) {
+		t.Fatalf("count %d != %d: %v", n, len(expected), err)
+	}
+	var j int
+	if err = compacted.Iterate(func(l Link) error {
+		if l != expected[j] {
+			t.Errorf("%v != %v", l, expected[j])
+		}
+		j++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// old ids are resolved to same files by mapping
+	for oldID, id := range ids {
+		l, err := compacted.ReadBuff(id, NewLinkBuffer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Offset != Offset(oldID)*100/2 {
+			t.Errorf("%d -> %d: offset %d != %d", oldID, id, l.Offset, Offset(oldID)*100/2)
+		}
+	}
+
+	if err = src.Compact(dst, func(l Link, _ FileID) (Link, bool) { return l, true }); err != ErrCompactNotEmpty {
+		t.Errorf("%v != %v", err, ErrCompactNotEmpty)
+	}
+}
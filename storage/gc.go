@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"time"
+
+	"cydev.ru/hath"
+)
+
+// Reclaimable is space in bulk that can be freed by evicting files
+type Reclaimable struct {
+	// Files is count of files that can be evicted
+	Files int64 `json:"files"`
+	// Bytes is total size of files with their headers in bulk
+	Bytes int64 `json:"bytes"`
+}
+
+// ReclaimableBefore returns space that would be freed by evicting files that were not used
+// since deadline (see hath.File.LastUsageBefore). Index is iterated with Index.Iterate and
+// every linked file is loaded by load, while gaps and tombstones are skipped.
+// Iteration stops on first error returned by load.
+func (i Index) ReclaimableBefore(deadline time.Time, load func(Link) (hath.File, error)) (Reclaimable, error) {
+	var (
+		r  Reclaimable
+		id FileID
+	)
+	err := i.Iterate(func(l Link) error {
+		// gaps are empty links, so their ID does not match position
+		defer func() { id++ }()
+		if l.ID != id || l.Offset < 0 {
+			return nil
+		}
+		f, err := load(l)
+		if err != nil {
+			return err
+		}
+		if f.LastUsageBefore(deadline) {
+			r.Files++
+			r.Bytes += HeaderStructureSize + f.Size
+		}
+		return nil
+	})
+	return r, err
+}
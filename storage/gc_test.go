@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"cydev.ru/hath"
+)
+
+func TestIndex_ReclaimableBefore(t *testing.T) {
+	var (
+		index    = Index{Backend: &MemoryBackend{}}
+		deadline = time.Unix(1474117323, 0)
+		files    = map[FileID]hath.File{
+			0: {Size: 100, LastUsage: deadline.Unix() - 1},
+			1: {Size: 200, LastUsage: deadline.Unix()},
+			2: {Size: 300, LastUsage: deadline.Unix() + 1},
+			4: {Size: 400, LastUsage: 0},
+			5: {Size: 500, LastUsage: 0},
+		}
+	)
+	for id := range files {
+		l := Link{ID: id, Offset: Offset(id) * 1000}
+		if id == 5 {
+			// deleted
+			l.Offset = -1
+		}
+		if err := index.Write(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loads := 0
+	load := func(l Link) (hath.File, error) {
+		loads++
+		f, ok := files[l.ID]
+		if !ok {
+			t.Errorf("unexpected load of %v", l)
+		}
+		return f, nil
+	}
+	r, err := index.ReclaimableBefore(deadline, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Reclaimable{Files: 2, Bytes: 2*HeaderStructureSize + 100 + 400}
+	if r != expected {
+		t.Errorf("%+v != %+v", r, expected)
+	}
+	if loads != 4 {
+		t.Errorf("loads %d != %d", loads, 4)
+	}
+
+	errLoad := errors.New("load failed")
+	_, err = index.ReclaimableBefore(deadline, func(l Link) (hath.File, error) {
+		return hath.File{}, errLoad
+	})
+	if err != errLoad {
+		t.Errorf("%v != %v", err, errLoad)
+	}
+}
@@ -32,14 +32,14 @@ import (
 //    |                                         |
 //    |-----------------------------------------| size + 16
 type Header struct {
-	ID        int64 // -> Link.ID
-	Offset    int64 // -> Link.Offset
-	Size      int64 // len(data)
-	Timestamp int64 // Time.Unix()
+	ID        FileID // -> Link.ID
+	Offset    Offset // -> Link.Offset
+	Size      int64  // len(data)
+	Timestamp int64  // Time.Unix()
 }
 
 // DataOffset returns offset for data, associated with Header
-func (h Header) DataOffset() int64 {
+func (h Header) DataOffset() Offset {
 	return h.Offset + HeaderStructureSize
 }
 
@@ -58,11 +58,13 @@ func NewHeaderBuffer() []byte {
 // Read header from byte slice using binary.PutVariant for all fields, returns read size in bytes.
 func (h *Header) Read(b []byte) int {
 	var offset, read int
-	h.ID, read = binary.Varint(b[offset:])
+	id, read := binary.Varint(b[offset:])
+	h.ID = FileID(id)
 	offset += read
 	h.Size, read = binary.Varint(b[offset:])
 	offset += read
-	h.Offset, read = binary.Varint(b[offset:])
+	off, read := binary.Varint(b[offset:])
+	h.Offset = Offset(off)
 	offset += read
 	h.Timestamp, read = binary.Varint(b[offset:])
 	return offset + read
@@ -71,9 +73,9 @@ func (h *Header) Read(b []byte) int {
 // Put header to byte slice using binary.PutVariant for all fields, returns write size in bytes.
 func (h Header) Put(b []byte) int {
 	var offset int
-	offset += binary.PutVarint(b[offset:], h.ID)
+	offset += binary.PutVarint(b[offset:], int64(h.ID))
 	offset += binary.PutVarint(b[offset:], h.Size)
-	offset += binary.PutVarint(b[offset:], h.Offset)
+	offset += binary.PutVarint(b[offset:], int64(h.Offset))
 	offset += binary.PutVarint(b[offset:], h.Timestamp)
 	return offset
 }
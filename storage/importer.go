@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"io"
+	"time"
+
+	"cydev.ru/hath"
+)
+
+// importBufferSize is size of buffer used to copy file data to bulk
+const importBufferSize = 32 * 1024
+
+// Importer writes files to bulk and links them in index in one pass.
+// Importer is not safe for concurrent use.
+type Importer struct {
+	Bulk      io.WriterAt
+	Allocator *Allocator
+	Index     Index
+
+	buf []byte
+}
+
+// Add allocates space for file in bulk, writes header and data, verifies sha1 hash and size of data
+// and appends link to index, returning ID of file. On failure allocated space is returned to Allocator,
+// so nothing is linked and space can be reused.
+func (imp *Importer) Add(f hath.File, data io.Reader) (FileID, error) {
+	count, err := imp.Index.Count()
+	if err != nil {
+		return 0, err
+	}
+	h := Header{
+		ID:        FileID(count),
+		Size:      f.Size,
+		Timestamp: time.Now().Unix(),
+	}
+	size := HeaderStructureSize + f.Size
+	h.Offset = imp.Allocator.Alloc(size)
+	if err = imp.write(h, f, data); err != nil {
+		imp.Allocator.Free(h.Offset, size)
+		return 0, err
+	}
+	return h.ID, nil
+}
+
+func (imp *Importer) write(h Header, f hath.File, data io.Reader) error {
+	if imp.buf == nil {
+		imp.buf = make([]byte, importBufferSize)
+	}
+	var (
+		hasher = sha1.New()
+		offset = h.DataOffset()
+		r      = io.LimitReader(data, h.Size+1)
+	)
+	for {
+		n, err := r.Read(imp.buf)
+		if n > 0 {
+			if offset+Offset(n) > h.DataOffset()+Offset(h.Size) {
+				return hath.ErrSizeMismatch
+			}
+			hasher.Write(imp.buf[:n])
+			if _, werr := imp.Bulk.WriteAt(imp.buf[:n], int64(offset)); werr != nil {
+				return werr
+			}
+			offset += Offset(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if offset != h.DataOffset()+Offset(h.Size) {
+		return hath.ErrSizeMismatch
+	}
+	var hash [hath.HashSize]byte
+	copy(hash[:], hasher.Sum(nil))
+	if hash != f.Hash {
+		return hath.ErrHashMismatch
+	}
+	header := NewHeaderBuffer()
+	h.Put(header)
+	if _, err := imp.Bulk.WriteAt(header, int64(h.Offset)); err != nil {
+		return err
+	}
+	return imp.Index.Write(Link{ID: h.ID, Offset: h.Offset})
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+
+	"cydev.ru/hath"
+)
+
+func importerFile(data []byte) hath.File {
+	return hath.File{Hash: sha1.Sum(data), Size: int64(len(data)), Type: hath.JPG}
+}
+
+func TestImporter_Add(t *testing.T) {
+	bulkFile := tempFile(t)
+	defer clearTempFile(bulkFile, t)
+	indexFile := tempFile(t)
+	defer clearTempFile(indexFile, t)
+	imp := &Importer{
+		Bulk:      bulkFile,
+		Allocator: NewAllocator(0),
+		Index:     Index{Backend: indexFile},
+	}
+
+	data := bytes.Repeat([]byte("hath"), importBufferSize/2)
+	id, err := imp.Add(importerFile(data), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 0 {
+		t.Errorf("%d != %d", id, 0)
+	}
+	end := imp.Allocator.End()
+
+	// failed files should not be linked and should not consume space
+	bad := importerFile(data[1:])
+	if _, err := imp.Add(bad, bytes.NewReader(data)); err != hath.ErrSizeMismatch {
+		t.Errorf("%v != %v", err, hath.ErrSizeMismatch)
+	}
+	bad = importerFile(data)
+	bad.Hash[0]++
+	if _, err := imp.Add(bad, bytes.NewReader(data)); err != hath.ErrHashMismatch {
+		t.Errorf("%v != %v", err, hath.ErrHashMismatch)
+	}
+	if imp.Allocator.End() != end {
+		t.Errorf("allocator end %d != %d after failures", imp.Allocator.End(), end)
+	}
+
+	second := []byte("second file")
+	id, err = imp.Add(importerFile(second), bytes.NewReader(second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Errorf("%d != %d", id, 1)
+	}
+
+	for i, expected := range [][]byte{data, second} {
+		l, err := imp.Index.ReadBuff(FileID(i), NewLinkBuffer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := Bulk{Backend: bulkFile}
+		h, err := b.ReadHeader(l, NewHeaderBuffer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, h.Size)
+		if err := b.ReadData(h, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, expected) {
+			t.Errorf("file %d data mismatch", i)
+		}
+	}
+}
@@ -1,21 +1,117 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
 	"os"
 )
 
+// FileID is position of file link in index, starting from 0
+type FileID int64
+
+// Offset is position of byte in backend, e.g. offset of Header in bulk
+type Offset int64
+
 // Link is index entry that links file id to offset, ID is key, Offset is value.
 //
 // Collection L = {L1, L2, ..., Ln} defines f(ID) -> Offset on id in L, so
 // L is an associative array (ID, Offset).
 type Link struct {
-	ID     int64 // -> Header.ID
-	Offset int64 // -> Header.Offset
+	ID     FileID // -> Header.ID
+	Offset Offset // -> Header.Offset
+}
+
+// TombstoneOffset is Link.Offset of deleted file, see Index.Delete.
+// Any negative offset is treated as tombstone.
+const TombstoneOffset Offset = -1
+
+// Deleted reports whether link is tombstone of deleted file.
+func (l Link) Deleted() bool {
+	return l.Offset < 0
+}
+
+// LinkStructureSize is minimum buf length required in Link.{Read,Put} and is 160 bit or 20 byte:
+// ID and Offset followed by crc32 of them.
+const LinkStructureSize = 8*2 + crc32.Size
+
+// LinkStructureSizeV1 is size of Link in previous format without checksum, see Link.ReadV1.
+const LinkStructureSizeV1 = 8 * 2
+
+// IndexHeaderSize is size of header at start of index, that takes one link slot,
+// so links are aligned by LinkStructureSize. Header is magic, IndexFormatVersion,
+// reserved bytes and crc32 of them:
+//
+//	| magic (8 bytes) | version (4 bytes) | reserved (4 bytes) | crc32 |
+const IndexHeaderSize = LinkStructureSize
+
+// IndexFormatVersion is version of index format written to header. Version 1 is
+// previous format without header and link checksums, see Index.MigrateV1.
+const IndexFormatVersion = 2
+
+// indexMagic starts header of index
+var indexMagic = [8]byte{'h', 'a', 't', 'h', 'i', 'd', 'x', 0}
+
+var (
+	// ErrIndexFormatV1 is returned by Index.Open if index has no header, e.g. is
+	// in previous format, and should be converted with Index.MigrateV1
+	ErrIndexFormatV1 = errors.New("Index has no header, migrate it from previous format with Index.MigrateV1")
+	// ErrIndexVersion is returned by Index.Open if index has unsupported format version
+	ErrIndexVersion = errors.New("Index format version is not supported")
+)
+
+// putIndexHeader writes index header of IndexFormatVersion to b
+func putIndexHeader(b []byte) {
+	copy(b, indexMagic[:])
+	binary.BigEndian.PutUint32(b[8:12], IndexFormatVersion)
+	binary.BigEndian.PutUint32(b[12:16], 0)
+	binary.BigEndian.PutUint32(b[16:IndexHeaderSize], crc32.ChecksumIEEE(b[:16]))
 }
 
-// LinkStructureSize is minimum buf length required in Link.{Read,Put} and is 128 bit or 16 byte.
-const LinkStructureSize = 8 * 2
+// writeHeader writes index header to backend
+func (i Index) writeHeader() error {
+	b := make([]byte, IndexHeaderSize)
+	putIndexHeader(b)
+	_, err := i.Backend.WriteAt(b, 0)
+	return err
+}
+
+// Open checks header of index, so index in other format is not misread, or writes
+// header if backend is empty. Returns ErrIndexFormatV1 if index has no header,
+// ErrIndexVersion if header has other version, or ErrIndexCorrupted if header is damaged.
+// Index should be opened once before use, as other methods do not check header,
+// but header of empty index is also written on first write, see Index.WriteBuff.
+func (i Index) Open() error {
+	info, err := i.Backend.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return i.writeHeader()
+	}
+	b := make([]byte, IndexHeaderSize)
+	if n, err := i.Backend.ReadAt(b, 0); n < len(b) {
+		if err == nil || err == io.EOF {
+			err = ErrIndexFormatV1
+		}
+		return err
+	}
+	if !bytes.Equal(b[:len(indexMagic)], indexMagic[:]) {
+		return ErrIndexFormatV1
+	}
+	if binary.BigEndian.Uint32(b[16:IndexHeaderSize]) != crc32.ChecksumIEEE(b[:16]) {
+		return ErrIndexCorrupted
+	}
+	if binary.BigEndian.Uint32(b[8:12]) != IndexFormatVersion {
+		return ErrIndexVersion
+	}
+	return nil
+}
+
+// ErrLinkCorrupt is returned on reading Link with checksum mismatch, e.g. after partial write or bit flip
+var ErrLinkCorrupt = errors.New("Index link checksum mismatch")
 
 // NewLinkBuffer is shorthand for new []byte slice with length LinkStructureSize
 // that is safe to pass as buffer to all Link-related Read/Write methods.
@@ -33,45 +129,314 @@ type IndexBackend interface {
 // Index uses IndexBackend to store and retrieve Links
 type Index struct {
 	Backend IndexBackend
+	// Checkpoints is optional sidecar for block checksums, see Index.Checkpoint
+	Checkpoints IndexBackend
 }
 
-// ReadBuff returns Link with provided id using provided buffer during serialization
-func (i Index) ReadBuff(id int64, b []byte) (Link, error) {
+// ErrLinkDeleted is returned by Index.ReadBuff for tombstone link, see Index.Delete
+var ErrLinkDeleted = errors.New("Index link is deleted")
+
+// ReadBuff returns Link with provided id using provided buffer during serialization.
+// Returns tombstone link and ErrLinkDeleted if link was deleted.
+func (i Index) ReadBuff(id FileID, b []byte) (Link, error) {
 	l := Link{}
-	n, err := i.Backend.ReadAt(b, getLinkOffset(id))
+	n, err := i.Backend.ReadAt(b, int64(getLinkOffset(id)))
 	if err != nil {
 		return l, err
 	}
-	l.Read(b[:n])
+	if _, err = l.Read(b[:n]); err != nil {
+		return l, err
+	}
+	if l.Deleted() {
+		return l, ErrLinkDeleted
+	}
 	return l, nil
 }
 
-// WriteBuff writes Link using provided buffer during deserialization
+// WriteBuff writes Link using provided buffer during deserialization.
+// If link is in block that is already covered by checkpoint, e.g. on Delete,
+// checksum of block is recomputed, see Index.Checkpoint.
+// Header is written first if backend is empty, so index can be opened later.
 func (i Index) WriteBuff(l Link, b []byte) error {
+	info, err := i.Backend.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if err = i.writeHeader(); err != nil {
+			return err
+		}
+	}
 	l.Put(b)
-	_, err := i.Backend.WriteAt(b, getLinkOffset(l.ID))
-	return err
+	if _, err := i.Backend.WriteAt(b, int64(getLinkOffset(l.ID))); err != nil {
+		return err
+	}
+	return i.updateCheckpoint(l.ID)
+}
+
+// ReadRange returns up to count links starting from startID using single read from backend.
+// If index ends before startID+count, only complete links that were read are returned.
+func (i Index) ReadRange(startID FileID, count int64) ([]Link, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+	buf := make([]byte, count*LinkStructureSize)
+	n, err := i.Backend.ReadAt(buf, int64(getLinkOffset(startID)))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	links := make([]Link, n/LinkStructureSize)
+	for j := range links {
+		if _, err = links[j].Read(buf[j*LinkStructureSize:]); err != nil {
+			return nil, err
+		}
+	}
+	return links, nil
+}
+
+// ErrNegativeID is returned on attempt to write Link with negative ID
+var ErrNegativeID = errors.New("Index negative link id")
+
+// Write writes Link to its position in index, that is l.ID * LinkStructureSize.
+// Index is sparse array, so IDs should be contiguous, otherwise gaps between them
+// are filled with empty links and take space in backend.
+// Returns ErrNegativeID if l.ID is negative.
+func (i Index) Write(l Link) error {
+	if l.ID < 0 {
+		return ErrNegativeID
+	}
+	return i.WriteBuff(l, NewLinkBuffer())
+}
+
+// Delete marks link with provided id as deleted by writing tombstone link with
+// TombstoneOffset in its place, as links are positional and can't be removed
+// without shifting following ones. Tombstones are dropped by compaction.
+// Returns ErrNegativeID if id is negative.
+func (i Index) Delete(id FileID) error {
+	return i.Write(Link{ID: id, Offset: TombstoneOffset})
+}
+
+// Count returns number of links in index, including empty ones in gaps.
+// Returns ErrIndexCorrupted if backend size is not header and multiple of LinkStructureSize,
+// e.g. if last write was interrupted.
+func (i Index) Count() (int64, error) {
+	info, err := i.Backend.Stat()
+	if err != nil {
+		return 0, err
+	}
+	count, aligned := linksCount(info.Size())
+	if !aligned {
+		return 0, ErrIndexCorrupted
+	}
+	return count, nil
+}
+
+// Cursor iterates over Index in chunks, remembering position between calls,
+// so pages can be fetched one by one without re-scanning index from start.
+// Cursor is not safe for concurrent use.
+type Cursor struct {
+	index Index
+	id    FileID
+	buf   []byte
+	err   error
+}
+
+// Cursor returns new Cursor positioned at the first link of index.
+func (i Index) Cursor() *Cursor {
+	return &Cursor{index: i}
+}
+
+// Next returns up to n links starting from current position and reports whether more links remain.
+// Index size is checked on every call, so links appended after previous call are visible.
+// On error Next returns false and error is available via Err.
+func (c *Cursor) Next(n int) ([]Link, bool) {
+	if c.err != nil {
+		return nil, false
+	}
+	info, err := c.index.Backend.Stat()
+	if err != nil {
+		c.err = err
+		return nil, false
+	}
+	links, _ := linksCount(info.Size())
+	total := FileID(links)
+	count := int64(total - c.id)
+	if count > int64(n) {
+		count = int64(n)
+	}
+	if count <= 0 {
+		return nil, c.id < total
+	}
+	size := count * LinkStructureSize
+	if int64(cap(c.buf)) < size {
+		c.buf = make([]byte, size)
+	}
+	buf := c.buf[:size]
+	read, err := c.index.Backend.ReadAt(buf, int64(getLinkOffset(c.id)))
+	if err != nil && !(err == io.EOF && read == len(buf)) {
+		c.err = err
+		return nil, false
+	}
+	result := make([]Link, count)
+	for j := range result {
+		if _, err = result[j].Read(buf[int64(j)*LinkStructureSize:]); err != nil {
+			c.err = err
+			return nil, false
+		}
+	}
+	c.id += FileID(count)
+	return result, c.id < total
+}
+
+// Err returns first error occurred during iteration, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// iteratePageSize is count of links read at once by Index.Iterate
+const iteratePageSize = 4 * 1024
+
+// Iterate calls fn for every link of index in order of ID, reading index in pages of
+// iteratePageSize links. Gaps in index are passed to fn as empty links, and trailing
+// partial link is skipped. Iteration stops on first error returned by fn or read error.
+func (i Index) Iterate(fn func(Link) error) error {
+	c := i.Cursor()
+	for {
+		links, more := c.Next(iteratePageSize)
+		for _, l := range links {
+			if err := fn(l); err != nil {
+				return err
+			}
+		}
+		if !more {
+			return c.Err()
+		}
+	}
+}
+
+// live reports whether link read at position id is neither gap nor tombstone.
+// Gaps are empty links, so their ID does not match position, except the first
+// one, that is indistinguishable from file 0 at offset 0.
+func (l Link) live(id FileID) bool {
+	return l.ID == id && !l.Deleted()
+}
+
+// IterateLive is Index.Iterate that skips gaps and tombstones, so fn is called
+// only for links of existing files.
+func (i Index) IterateLive(fn func(Link) error) error {
+	var id FileID
+	return i.Iterate(func(l Link) error {
+		id++
+		if !l.live(id - 1) {
+			return nil
+		}
+		return fn(l)
+	})
+}
+
+// CountLive returns number of links in index, excluding gaps and tombstones.
+// Unlike Index.Count, whole index is read.
+func (i Index) CountLive() (int64, error) {
+	var count int64
+	err := i.IterateLive(func(Link) error {
+		count++
+		return nil
+	})
+	return count, err
 }
 
 // getLinkOffset returns offset in index for link with provided file id.
-// Link.ID starts from 0, so getLinkOffset(0) == 0, getLinkOffset(1) == LinkStructureSize.
-func getLinkOffset(id int64) int64 {
-	return id * LinkStructureSize
+// Link.ID starts from 0 and links follow index header, so
+// getLinkOffset(0) == IndexHeaderSize, getLinkOffset(1) == IndexHeaderSize + LinkStructureSize.
+func getLinkOffset(id FileID) Offset {
+	return IndexHeaderSize + Offset(id)*LinkStructureSize
+}
+
+// linksCount returns count of complete links in index of provided backend size
+// and whether size is exactly header and complete links, i.e. last write was not torn.
+// Missing header is not counted as partial, as it is written by Index.Open.
+func linksCount(size int64) (count int64, aligned bool) {
+	if size <= IndexHeaderSize {
+		return 0, size == 0 || size == IndexHeaderSize
+	}
+	size -= IndexHeaderSize
+	return size / LinkStructureSize, size%LinkStructureSize == 0
 }
 
-// Put link to byte slice using binary.PutVariant for all fields, returns write size in bytes.
+// Put link to byte slice as two fixed-width big endian int64 values and crc32 of them, so every
+// Link takes exactly LinkStructureSize bytes regardless of values and index has fixed stride.
+// Returns write size in bytes.
 func (l Link) Put(b []byte) int {
-	var offset int
-	offset += binary.PutVarint(b[offset:], l.ID)
-	offset += binary.PutVarint(b[offset:], l.Offset)
-	return offset
-}
-
-// Read file from byte slice using binary.PutVariant for all fields, returns read size in bytes.
-func (l *Link) Read(b []byte) int {
-	var offset, read int
-	l.ID, read = binary.Varint(b[offset:])
-	offset += read
-	l.Offset, read = binary.Varint(b[offset:])
-	return offset + read
+	binary.BigEndian.PutUint64(b[:8], uint64(l.ID))
+	binary.BigEndian.PutUint64(b[8:LinkStructureSizeV1], uint64(l.Offset))
+	binary.BigEndian.PutUint32(b[LinkStructureSizeV1:LinkStructureSize], crc32.ChecksumIEEE(b[:LinkStructureSizeV1]))
+	return LinkStructureSize
+}
+
+// emptyLinkBytes is serialized gap in index, that is read as empty Link
+var emptyLinkBytes [LinkStructureSize]byte
+
+// Read link from byte slice written by Link.Put, returns read size in bytes, or ErrLinkCorrupt
+// if checksum does not match. Zeroed bytes are gap in index and are read as empty Link.
+func (l *Link) Read(b []byte) (int, error) {
+	b = b[:LinkStructureSize]
+	if bytes.Equal(b, emptyLinkBytes[:]) {
+		*l = Link{}
+		return LinkStructureSize, nil
+	}
+	if binary.BigEndian.Uint32(b[LinkStructureSizeV1:]) != crc32.ChecksumIEEE(b[:LinkStructureSizeV1]) {
+		return LinkStructureSize, ErrLinkCorrupt
+	}
+	l.ReadV1(b)
+	return LinkStructureSize, nil
+}
+
+// ReadV1 reads link from byte slice in previous format without checksum,
+// that is LinkStructureSizeV1 bytes, returns read size in bytes.
+func (l *Link) ReadV1(b []byte) int {
+	l.ID = FileID(binary.BigEndian.Uint64(b[:8]))
+	l.Offset = Offset(binary.BigEndian.Uint64(b[8:LinkStructureSizeV1]))
+	return LinkStructureSizeV1
+}
+
+// MigrateV1 writes header and all links of index in previous format from src to i,
+// so index can be upgraded to format with header and checksums. Gaps are kept, and
+// trailing partial link is skipped.
+func (i Index) MigrateV1(src IndexBackend) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if err = i.writeHeader(); err != nil {
+		return err
+	}
+	var (
+		total = info.Size() / LinkStructureSizeV1
+		old   = make([]byte, LinkStructureSizeV1*iteratePageSize)
+		buf   = make([]byte, LinkStructureSize*iteratePageSize)
+		l     Link
+	)
+	for start := int64(0); start < total; start += iteratePageSize {
+		count := total - start
+		if count > iteratePageSize {
+			count = iteratePageSize
+		}
+		n, err := src.ReadAt(old[:count*LinkStructureSizeV1], start*LinkStructureSizeV1)
+		if err != nil && !(err == io.EOF && int64(n) == count*LinkStructureSizeV1) {
+			return err
+		}
+		for j := int64(0); j < count; j++ {
+			l.ReadV1(old[j*LinkStructureSizeV1:])
+			if l == (Link{}) {
+				// keeping gap zeroed
+				copy(buf[j*LinkStructureSize:(j+1)*LinkStructureSize], emptyLinkBytes[:])
+				continue
+			}
+			l.Put(buf[j*LinkStructureSize:])
+		}
+		if _, err = i.Backend.WriteAt(buf[:count*LinkStructureSize], int64(getLinkOffset(FileID(start)))); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -2,7 +2,11 @@ package storage
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"io/ioutil"
+	"math"
 	"os"
 	"testing"
 	"time"
@@ -82,12 +86,127 @@ func TestLink(t *testing.T) {
 	buf := make([]byte, LinkStructureSize)
 	l.Put(buf)
 	readL := Link{}
-	readL.Read(buf)
+	if _, err := readL.Read(buf); err != nil {
+		t.Fatal(err)
+	}
 	if l != readL {
 		t.Errorf("%v != %v", readL, l)
 	}
 }
 
+func TestLink_Corrupt(t *testing.T) {
+	l := Link{
+		ID:     1234,
+		Offset: 66234,
+	}
+	buf := NewLinkBuffer()
+	l.Put(buf)
+	for i := range buf {
+		for bit := uint(0); bit < 8; bit++ {
+			buf[i] ^= 1 << bit
+			readL := Link{}
+			if _, err := readL.Read(buf); err != ErrLinkCorrupt {
+				t.Errorf("byte %d bit %d: %v != %v", i, bit, err, ErrLinkCorrupt)
+			}
+			buf[i] ^= 1 << bit
+		}
+	}
+	// gap in index is empty link
+	readL := Link{ID: 1}
+	if _, err := readL.Read(make([]byte, LinkStructureSize)); err != nil {
+		t.Fatal(err)
+	}
+	if readL != (Link{}) {
+		t.Errorf("%v is not empty", readL)
+	}
+}
+
+func TestLink_ReadV1(t *testing.T) {
+	l := Link{
+		ID:     1234,
+		Offset: 66234,
+	}
+	buf := NewLinkBuffer()
+	l.Put(buf)
+	readL := Link{}
+	if n := readL.ReadV1(buf[:LinkStructureSizeV1]); n != LinkStructureSizeV1 {
+		t.Errorf("read %d != %d", n, LinkStructureSizeV1)
+	}
+	if l != readL {
+		t.Errorf("%v != %v", readL, l)
+	}
+}
+
+func TestIndex_MigrateV1(t *testing.T) {
+	var (
+		old   = &MemoryBackend{}
+		links = []Link{{ID: 0, Offset: 0}, {ID: 1, Offset: 100}, {ID: 3, Offset: 300}}
+		count = FileID(iteratePageSize + 2)
+	)
+	links = append(links, Link{ID: count - 1, Offset: 1000})
+	for _, l := range links {
+		buf := NewLinkBuffer()
+		l.Put(buf)
+		if _, err := old.WriteAt(buf[:LinkStructureSizeV1], int64(l.ID)*LinkStructureSizeV1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// trailing partial link
+	if _, err := old.WriteAt([]byte{1, 2}, int64(count)*LinkStructureSizeV1); err != nil {
+		t.Fatal(err)
+	}
+	if err := (Index{Backend: old}).Open(); err != ErrIndexFormatV1 {
+		t.Errorf("%v != %v", err, ErrIndexFormatV1)
+	}
+	index := Index{Backend: &MemoryBackend{}}
+	if err := index.MigrateV1(old); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := index.Count(); err != nil || n != int64(count) {
+		t.Fatalf("count %d != %d: %v", n, count, err)
+	}
+	for _, expected := range links {
+		l, err := index.ReadBuff(expected.ID, NewLinkBuffer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l != expected {
+			t.Errorf("%v != %v", l, expected)
+		}
+	}
+	if err := index.Open(); err != nil {
+		t.Errorf("migrated index: %v", err)
+	}
+	// gap
+	l, err := index.ReadBuff(2, NewLinkBuffer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != (Link{}) {
+		t.Errorf("%v is not empty", l)
+	}
+}
+
+func TestLink_Large(t *testing.T) {
+	for _, l := range []Link{
+		{ID: math.MaxInt64, Offset: math.MaxInt64},
+		{ID: math.MinInt64, Offset: math.MinInt64},
+		{ID: 1 << 62, Offset: -1},
+	} {
+		buf := make([]byte, LinkStructureSize)
+		if n := l.Put(buf); n != LinkStructureSize {
+			t.Errorf("put %d != %d", n, LinkStructureSize)
+		}
+		readL := Link{}
+		if n, err := readL.Read(buf); n != LinkStructureSize || err != nil {
+			t.Errorf("read %d != %d: %v", n, LinkStructureSize, err)
+		}
+		if l != readL {
+			t.Errorf("%v != %v", readL, l)
+		}
+	}
+}
+
 func BenchmarkLink_Put(b *testing.B) {
 	l := Link{
 		ID:     1234,
@@ -113,17 +232,26 @@ func BenchmarkLink_Read(b *testing.B) {
 	}
 }
 
+// writeTestHeader writes index header to memoryBackend, that ignores offsets
+// and appends all writes, so header should be written before links
+func writeTestHeader(backend *memoryBackend) {
+	b := make([]byte, IndexHeaderSize)
+	putIndexHeader(b)
+	backend.WriteAt(b, 0)
+}
+
 func TestGetLink(t *testing.T) {
 	l := getLinkOffset(10)
-	if l != 160 {
-		t.Fatalf("%v != %v", l, 160)
+	if l != IndexHeaderSize+200 {
+		t.Fatalf("%v != %v", l, IndexHeaderSize+200)
 	}
 }
 
 func TestIndex_ReadBuff(t *testing.T) {
 	var backend memoryBackend
+	writeTestHeader(&backend)
 	buf := make([]byte, LinkStructureSize)
-	var id int64
+	var id FileID
 	tmpLink := Link{
 		ID:     0,
 		Offset: 125,
@@ -131,7 +259,7 @@ func TestIndex_ReadBuff(t *testing.T) {
 	for id = 0; id < 10; id++ {
 		tmpLink.ID = id
 		tmpLink.Put(buf)
-		if _, err := backend.WriteAt(buf, getLinkOffset(id)); err != nil {
+		if _, err := backend.WriteAt(buf, int64(getLinkOffset(id))); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -150,8 +278,9 @@ func TestIndex_ReadBuff(t *testing.T) {
 
 func TestIndex_Read(t *testing.T) {
 	var backend memoryBackend
+	writeTestHeader(&backend)
 	buf := make([]byte, LinkStructureSize)
-	var id int64
+	var id FileID
 	tmpLink := Link{
 		ID:     0,
 		Offset: 125,
@@ -159,7 +288,7 @@ func TestIndex_Read(t *testing.T) {
 	for id = 0; id < 10; id++ {
 		tmpLink.ID = id
 		tmpLink.Put(buf)
-		if _, err := backend.WriteAt(buf, getLinkOffset(id)); err != nil {
+		if _, err := backend.WriteAt(buf, int64(getLinkOffset(id))); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -177,8 +306,9 @@ func TestIndex_Read(t *testing.T) {
 
 func BenchmarkIndex_ReadBuff(b *testing.B) {
 	var backend memoryBackend
+	writeTestHeader(&backend)
 	buf := make([]byte, LinkStructureSize)
-	var id int64
+	var id FileID
 	tmpLink := Link{
 		ID:     0,
 		Offset: 125,
@@ -186,7 +316,7 @@ func BenchmarkIndex_ReadBuff(b *testing.B) {
 	for id = 0; id < 10; id++ {
 		tmpLink.ID = id
 		tmpLink.Put(buf)
-		if _, err := backend.WriteAt(buf, getLinkOffset(id)); err != nil {
+		if _, err := backend.WriteAt(buf, int64(getLinkOffset(id))); err != nil {
 			b.Fatal(err)
 		}
 	}
@@ -228,3 +358,315 @@ func TestIndexOsFile(t *testing.T) {
 		t.Errorf("%v != %v", l, expected)
 	}
 }
+
+func TestIndex_Write(t *testing.T) {
+	index := Index{Backend: &MemoryBackend{}}
+	expected := Link{ID: 3, Offset: 1234}
+	if err := index.Write(expected); err != nil {
+		t.Fatal(err)
+	}
+	l, err := index.ReadBuff(expected.ID, NewLinkBuffer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != expected {
+		t.Errorf("%v != %v", l, expected)
+	}
+	if err := index.Write(Link{ID: -1}); err != ErrNegativeID {
+		t.Errorf("%v != %v", err, ErrNegativeID)
+	}
+}
+
+func TestIndex_ReadRange(t *testing.T) {
+	index := Index{Backend: &MemoryBackend{}}
+	for id := FileID(0); id < 10; id++ {
+		if err := index.Write(Link{ID: id, Offset: Offset(id) * 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links, err := index.ReadRange(2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 5 {
+		t.Fatalf("%d != %d", len(links), 5)
+	}
+	for j, l := range links {
+		if expected := (Link{ID: FileID(j + 2), Offset: Offset(j+2) * 100}); l != expected {
+			t.Errorf("%v != %v", l, expected)
+		}
+	}
+	if links, err = index.ReadRange(8, 5); err != nil || len(links) != 2 {
+		t.Errorf("short read: %v, %d != %d", err, len(links), 2)
+	}
+	if links, err = index.ReadRange(10, 5); err != nil || len(links) != 0 {
+		t.Errorf("read after end: %v, %d != %d", err, len(links), 0)
+	}
+}
+
+func benchmarkIndex(b *testing.B, count int) Index {
+	index := Index{Backend: &MemoryBackend{}}
+	for id := 0; id < count; id++ {
+		if err := index.Write(Link{ID: FileID(id), Offset: Offset(id)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return index
+}
+
+func BenchmarkIndex_ReadRange(b *testing.B) {
+	const count = 1024
+	index := benchmarkIndex(b, count)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := index.ReadRange(0, count); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIndex_ReadBuffLoop(b *testing.B) {
+	const count = 1024
+	index := benchmarkIndex(b, count)
+	buf := NewLinkBuffer()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for id := FileID(0); id < count; id++ {
+			if _, err := index.ReadBuff(id, buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestIndex_Iterate(t *testing.T) {
+	index := Index{Backend: &MemoryBackend{}}
+	const count = iteratePageSize + 10
+	for id := FileID(0); id < count; id++ {
+		if err := index.Write(Link{ID: id, Offset: Offset(id) * 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// trailing partial link should be skipped
+	if _, err := index.Backend.WriteAt([]byte{1, 2, 3}, int64(getLinkOffset(count))); err != nil {
+		t.Fatal(err)
+	}
+	var id FileID
+	err := index.Iterate(func(l Link) error {
+		if expected := (Link{ID: id, Offset: Offset(id) * 10}); l != expected {
+			t.Errorf("%v != %v", l, expected)
+		}
+		id++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != count {
+		t.Errorf("iterated %d != %d", id, count)
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = index.Iterate(func(l Link) error {
+		calls++
+		if l.ID == 5 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Errorf("%v != %v", err, errStop)
+	}
+	if calls != 6 {
+		t.Errorf("calls %d != %d", calls, 6)
+	}
+}
+
+func TestIndex_Count(t *testing.T) {
+	index := Index{Backend: NewMemoryBackend(make([]byte, IndexHeaderSize+5*LinkStructureSize))}
+	count, err := index.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("%d != %d", count, 5)
+	}
+	if err = index.Write(Link{ID: 9, Offset: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ = index.Count(); count != 10 {
+		t.Errorf("%d != %d", count, 10)
+	}
+	index = Index{Backend: NewMemoryBackend(make([]byte, IndexHeaderSize+2*LinkStructureSize+3))}
+	if _, err = index.Count(); err != ErrIndexCorrupted {
+		t.Errorf("%v != %v", err, ErrIndexCorrupted)
+	}
+	if count, _ = (Index{Backend: &MemoryBackend{}}).Count(); count != 0 {
+		t.Errorf("%d != %d", count, 0)
+	}
+}
+
+func TestIndex_Cursor(t *testing.T) {
+	var backend memoryBackend
+	writeTestHeader(&backend)
+	buf := make([]byte, LinkStructureSize)
+	var id FileID
+	for id = 0; id < 10; id++ {
+		l := Link{ID: id, Offset: Offset(id) * 100}
+		l.Put(buf)
+		if _, err := backend.WriteAt(buf, int64(getLinkOffset(id))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index := Index{Backend: &backend}
+	c := index.Cursor()
+	var (
+		links []Link
+		pages int
+	)
+	for {
+		page, more := c.Next(3)
+		pages++
+		links = append(links, page...)
+		if !more {
+			break
+		}
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if pages != 4 {
+		t.Errorf("pages %d != %d", pages, 4)
+	}
+	if len(links) != 10 {
+		t.Fatalf("len(links) %d != %d", len(links), 10)
+	}
+	for i, l := range links {
+		expected := Link{ID: FileID(i), Offset: Offset(i) * 100}
+		if l != expected {
+			t.Errorf("%v != %v", l, expected)
+		}
+	}
+	if page, more := c.Next(3); len(page) != 0 || more {
+		t.Errorf("unexpected page %v after end", page)
+	}
+}
+
+func TestIndex_Delete(t *testing.T) {
+	index := Index{Backend: &MemoryBackend{}}
+	for id := FileID(0); id < 6; id++ {
+		if id == 4 {
+			// gap
+			continue
+		}
+		if err := index.Write(Link{ID: id, Offset: Offset(id) * 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []FileID{1, 3} {
+		if err := index.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Delete(-1); err != ErrNegativeID {
+		t.Errorf("%v != %v", err, ErrNegativeID)
+	}
+	l, err := index.ReadBuff(1, NewLinkBuffer())
+	if err != ErrLinkDeleted {
+		t.Errorf("%v != %v", err, ErrLinkDeleted)
+	}
+	if expected := (Link{ID: 1, Offset: TombstoneOffset}); l != expected || !l.Deleted() {
+		t.Errorf("%v != %v", l, expected)
+	}
+	if l, err = index.ReadBuff(2, NewLinkBuffer()); err != nil || l.Deleted() {
+		t.Errorf("unexpected %v %v", l, err)
+	}
+
+	if count, err := index.Count(); err != nil || count != 6 {
+		t.Errorf("count %d != 6: %v", count, err)
+	}
+	if count, err := index.CountLive(); err != nil || count != 3 {
+		t.Errorf("live count %d != 3: %v", count, err)
+	}
+	var ids []FileID
+	if err = index.IterateLive(func(l Link) error {
+		ids = append(ids, l.ID)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[0] != 0 || ids[1] != 2 || ids[2] != 5 {
+		t.Errorf("unexpected live ids %v", ids)
+	}
+}
+
+func TestIndex_Open(t *testing.T) {
+	backend := &MemoryBackend{}
+	index := Index{Backend: backend}
+	if err := index.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if size := int64(len(backend.Bytes())); size != IndexHeaderSize {
+		t.Errorf("size %d != %d", size, IndexHeaderSize)
+	}
+	if err := index.Write(Link{ID: 0, Offset: 10}); err != nil {
+		t.Fatal(err)
+	}
+	// reopening existing index
+	if err := index.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := index.ReadBuff(0, NewLinkBuffer()); err != nil || l != (Link{ID: 0, Offset: 10}) {
+		t.Errorf("unexpected %v %v", l, err)
+	}
+
+	header := backend.Bytes()[:IndexHeaderSize]
+	for _, tt := range []struct {
+		name   string
+		header func(b []byte)
+		err    error
+	}{
+		{"zeroed", func(b []byte) {
+			copy(b, emptyLinkBytes[:])
+		}, ErrIndexFormatV1},
+		{"version", func(b []byte) {
+			binary.BigEndian.PutUint32(b[8:12], IndexFormatVersion+1)
+			binary.BigEndian.PutUint32(b[16:], crc32.ChecksumIEEE(b[:16]))
+		}, ErrIndexVersion},
+		{"checksum", func(b []byte) {
+			b[12] ^= 1
+		}, ErrIndexCorrupted},
+	} {
+		b := append([]byte(nil), header...)
+		tt.header(b)
+		if err := (Index{Backend: NewMemoryBackend(b)}).Open(); err != tt.err {
+			t.Errorf("%s: %v != %v", tt.name, err, tt.err)
+		}
+	}
+	if err := (Index{Backend: NewMemoryBackend(header[:5])}).Open(); err != ErrIndexFormatV1 {
+		t.Errorf("%v != %v", err, ErrIndexFormatV1)
+	}
+}
+
+func TestIndex_WriteOpen(t *testing.T) {
+	// index written without Open, e.g. by Importer or JournaledIndex
+	backend := &MemoryBackend{}
+	index := Index{Backend: backend}
+	if err := index.Write(Link{ID: 2, Offset: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := index.ReadBuff(2, NewLinkBuffer()); err != nil || l != (Link{ID: 2, Offset: 10}) {
+		t.Errorf("unexpected %v %v", l, err)
+	}
+	journaled := &JournaledIndex{Index: Index{Backend: &MemoryBackend{}}, Journal: &MemoryBackend{}}
+	if err := journaled.Write(Link{ID: 0, Offset: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := journaled.Index.Open(); err != nil {
+		t.Error(err)
+	}
+}
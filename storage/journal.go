@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// A JournalBackend describes a backend that is used for index journal.
+type JournalBackend interface {
+	ReadAt(b []byte, off int64) (int, error)
+	WriteAt(b []byte, off int64) (int, error)
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+const (
+	// journalOpWrite is journal operation for Index write
+	journalOpWrite byte = 1
+	// journalEntrySize is size of serialized journal entry:
+	//    | op | Link (LinkStructureSize bytes) | crc32 of op and Link |
+	journalEntrySize = 1 + LinkStructureSize + crc32.Size
+)
+
+// JournaledIndex is Index that appends every write to the journal before applying it to the backend,
+// so write, that was torn by crash, can be replayed on startup by Recover.
+// Journal is truncated on Flush, after all writes are applied.
+//
+// JournaledIndex is not safe for concurrent use.
+type JournaledIndex struct {
+	Index   Index
+	Journal JournalBackend
+}
+
+// Write appends link to journal and then writes it to index.
+func (j *JournaledIndex) Write(l Link) error {
+	info, err := j.Journal.Stat()
+	if err != nil {
+		return err
+	}
+	entry := make([]byte, journalEntrySize)
+	entry[0] = journalOpWrite
+	l.Put(entry[1 : 1+LinkStructureSize])
+	binary.BigEndian.PutUint32(entry[1+LinkStructureSize:], crc32.ChecksumIEEE(entry[:1+LinkStructureSize]))
+	if _, err = j.Journal.WriteAt(entry, info.Size()); err != nil {
+		return err
+	}
+	return j.Index.WriteBuff(l, entry[1:1+LinkStructureSize])
+}
+
+// Flush syncs index backend if it supports syncing and truncates journal,
+// as all journaled writes are already applied.
+func (j *JournaledIndex) Flush() error {
+	if s, ok := j.Index.Backend.(interface {
+		Sync() error
+	}); ok {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	return j.Journal.Truncate(0)
+}
+
+// Recover replays all complete journal entries to index and flushes it.
+// Replay stops on first torn or corrupted entry, as it and all following ones were never applied.
+// Should be called on startup before any writes.
+func (j *JournaledIndex) Recover() error {
+	info, err := j.Journal.Stat()
+	if err != nil {
+		return err
+	}
+	var (
+		l     Link
+		entry = make([]byte, journalEntrySize)
+	)
+	for offset := int64(0); offset+journalEntrySize <= info.Size(); offset += journalEntrySize {
+		n, err := j.Journal.ReadAt(entry, offset)
+		if err != nil && !(err == io.EOF && n == len(entry)) {
+			return err
+		}
+		crc := binary.BigEndian.Uint32(entry[1+LinkStructureSize:])
+		if entry[0] != journalOpWrite || crc != crc32.ChecksumIEEE(entry[:1+LinkStructureSize]) {
+			break
+		}
+		if _, err := l.Read(entry[1 : 1+LinkStructureSize]); err != nil {
+			return err
+		}
+		if err := j.Index.WriteBuff(l, entry[1:1+LinkStructureSize]); err != nil {
+			return err
+		}
+	}
+	return j.Flush()
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"testing"
+)
+
+func journalSize(j *JournaledIndex, t *testing.T) int64 {
+	info, err := j.Journal.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestJournaledIndex(t *testing.T) {
+	indexFile := tempFile(t)
+	defer clearTempFile(indexFile, t)
+	journalFile := tempFile(t)
+	defer clearTempFile(journalFile, t)
+	j := &JournaledIndex{Index: Index{Backend: indexFile}, Journal: journalFile}
+
+	expected := Link{ID: 0, Offset: 1234}
+	if err := j.Write(expected); err != nil {
+		t.Fatal(err)
+	}
+	if size := journalSize(j, t); size != journalEntrySize {
+		t.Errorf("journal size %d != %d", size, journalEntrySize)
+	}
+	l, err := j.Index.ReadBuff(expected.ID, NewLinkBuffer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != expected {
+		t.Errorf("%v != %v", l, expected)
+	}
+	if err := j.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if size := journalSize(j, t); size != 0 {
+		t.Errorf("journal size %d != %d after flush", size, 0)
+	}
+}
+
+func TestJournaledIndex_Recover(t *testing.T) {
+	indexFile := tempFile(t)
+	defer clearTempFile(indexFile, t)
+	journalFile := tempFile(t)
+	defer clearTempFile(journalFile, t)
+	j := &JournaledIndex{Index: Index{Backend: indexFile}, Journal: journalFile}
+
+	// simulating crash after journal write, but before index write
+	links := []Link{
+		{ID: 0, Offset: 100},
+		{ID: 1, Offset: 200},
+		{ID: 2, Offset: 300},
+	}
+	crashed := &JournaledIndex{Index: Index{Backend: &memoryBackend{}}, Journal: journalFile}
+	for _, l := range links {
+		if err := crashed.Write(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// simulating torn write of last entry
+	torn := make([]byte, journalEntrySize)
+	torn[0] = journalOpWrite
+	Link{ID: 3, Offset: 400}.Put(torn[1:])
+	if _, err := journalFile.WriteAt(torn[:journalEntrySize/2], journalSize(j, t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if size := journalSize(j, t); size != 0 {
+		t.Errorf("journal size %d != %d after recover", size, 0)
+	}
+	for _, expected := range links {
+		l, err := j.Index.ReadBuff(expected.ID, NewLinkBuffer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l != expected {
+			t.Errorf("%v != %v", l, expected)
+		}
+	}
+	if _, err := j.Index.ReadBuff(3, NewLinkBuffer()); err == nil {
+		t.Error("torn entry should not be replayed")
+	}
+}
+
+func TestJournaledIndex_RecoverCorrupted(t *testing.T) {
+	indexFile := tempFile(t)
+	defer clearTempFile(indexFile, t)
+	journalFile := tempFile(t)
+	defer clearTempFile(journalFile, t)
+	j := &JournaledIndex{Index: Index{Backend: indexFile}, Journal: journalFile}
+
+	crashed := &JournaledIndex{Index: Index{Backend: &memoryBackend{}}, Journal: journalFile}
+	for _, l := range []Link{{ID: 0, Offset: 100}, {ID: 1, Offset: 200}} {
+		if err := crashed.Write(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// corrupting offset of second entry
+	if _, err := journalFile.WriteAt([]byte{0xFF}, journalEntrySize+LinkStructureSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := indexFile.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != IndexHeaderSize+LinkStructureSize {
+		t.Errorf("index size %d != %d, corrupted entry should not be replayed", info.Size(), IndexHeaderSize+LinkStructureSize)
+	}
+}
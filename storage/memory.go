@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNegativeOffset is returned by MemoryBackend on negative offset
+var ErrNegativeOffset = errors.New("MemoryBackend negative offset")
+
+// MemoryBackend is IndexBackend that stores data in memory, growing on writes
+// like *os.File does. It is useful for tests and small deployments that don't
+// need persistence. Zero value is empty backend. MemoryBackend is safe for concurrent use.
+type MemoryBackend struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// NewMemoryBackend returns MemoryBackend with initial content of data,
+// that is used directly and should not be modified after call
+func NewMemoryBackend(data []byte) *MemoryBackend {
+	return &MemoryBackend{data: data}
+}
+
+// ReadAt reads len(b) bytes from backend starting at off,
+// returning io.EOF if less bytes are available
+func (m *MemoryBackend) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, m.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes b to backend starting at off, growing it if needed,
+// and gap between previous end and off is filled with zeroes
+func (m *MemoryBackend) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if end := off + int64(len(b)); end > int64(len(m.data)) {
+		if end <= int64(cap(m.data)) {
+			// zeroing reused capacity, that can contain data from truncation
+			tail := m.data[len(m.data):end]
+			for i := range tail {
+				tail[i] = 0
+			}
+			m.data = m.data[:end]
+		} else {
+			m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+		}
+	}
+	return copy(m.data[off:], b), nil
+}
+
+// Stat returns os.FileInfo with current size of backend
+func (m *MemoryBackend) Stat() (os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return memoryFileInfo(len(m.data)), nil
+}
+
+// Truncate changes size of backend, like os.File.Truncate
+func (m *MemoryBackend) Truncate(size int64) error {
+	if size < 0 {
+		return ErrNegativeOffset
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size <= int64(len(m.data)) {
+		m.data = m.data[:size]
+		return nil
+	}
+	m.data = append(m.data, make([]byte, size-int64(len(m.data)))...)
+	return nil
+}
+
+// Bytes returns copy of backend content
+func (m *MemoryBackend) Bytes() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]byte(nil), m.data...)
+}
+
+// memoryFileInfo is os.FileInfo of MemoryBackend with its size
+type memoryFileInfo int64
+
+func (i memoryFileInfo) Name() string       { return "memory" }
+func (i memoryFileInfo) Size() int64        { return int64(i) }
+func (i memoryFileInfo) Mode() os.FileMode  { return os.FileMode(0666) }
+func (i memoryFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memoryFileInfo) IsDir() bool        { return false }
+func (i memoryFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	var backend MemoryBackend
+	if _, err := backend.WriteAt([]byte{1, 2, 3}, 5); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backend.Bytes(), []byte{0, 0, 0, 0, 0, 1, 2, 3}) {
+		t.Errorf("unexpected content %v", backend.Bytes())
+	}
+	if _, err := backend.WriteAt([]byte{4}, 1); err != nil {
+		t.Fatal(err)
+	}
+	info, err := backend.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 8 {
+		t.Errorf("size %d != 8", info.Size())
+	}
+	b := make([]byte, 4)
+	n, err := backend.ReadAt(b, 6)
+	if err != io.EOF || n != 2 || !bytes.Equal(b[:n], []byte{2, 3}) {
+		t.Errorf("unexpected read %v %d %v", err, n, b[:n])
+	}
+	if _, err = backend.ReadAt(b, 8); err != io.EOF {
+		t.Errorf("%v != %v", err, io.EOF)
+	}
+	if _, err = backend.ReadAt(b, -1); err != ErrNegativeOffset {
+		t.Errorf("%v != %v", err, ErrNegativeOffset)
+	}
+	if err = backend.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	// gap after truncation must be zeroed
+	if _, err := backend.WriteAt([]byte{5}, 4); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backend.Bytes(), []byte{0, 4, 0, 0, 5}) {
+		t.Errorf("unexpected content %v", backend.Bytes())
+	}
+}
+
+func TestIndexMemoryBackend(t *testing.T) {
+	index := Index{Backend: &MemoryBackend{}}
+	b := NewLinkBuffer()
+	// writing out of order to grow backend with gaps
+	links := []Link{
+		{ID: 5, Offset: 500},
+		{ID: 0, Offset: 12},
+		{ID: 2, Offset: 1234},
+		{ID: 7, Offset: 66234},
+	}
+	for _, l := range links {
+		if err := index.WriteBuff(l, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := index.Backend.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != IndexHeaderSize+8*LinkStructureSize {
+		t.Errorf("size %d != %d", info.Size(), IndexHeaderSize+8*LinkStructureSize)
+	}
+	for _, expected := range links {
+		l, err := index.ReadBuff(expected.ID, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l != expected {
+			t.Errorf("%v != %v", l, expected)
+		}
+	}
+	l, err := index.ReadBuff(3, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != (Link{}) {
+		t.Errorf("gap link %v is not empty", l)
+	}
+}
@@ -0,0 +1,67 @@
+package storage
+
+// metricsPageSize is count of links read at once while collecting metrics
+const metricsPageSize = 16 * 1024
+
+// IndexMetrics is snapshot of index health, suitable for JSON
+type IndexMetrics struct {
+	// Entries is count of links in index, including tombstones
+	Entries int64 `json:"entries"`
+	// Size is size of index backend in bytes
+	Size int64 `json:"size"`
+	// Tombstones is count of links that are marked as deleted (with negative offset)
+	Tombstones int64 `json:"tombstones"`
+	// Checkpoints is count of recorded checkpoints, zero if index has no checkpoints backend
+	Checkpoints int64 `json:"checkpoints"`
+	// Valid is true if links after last checkpoint are valid, see Index.ValidateTail
+	Valid bool `json:"valid"`
+	// Error is description of error occurred during collecting metrics, if any
+	Error string `json:"error,omitempty"`
+}
+
+// Metrics returns index metrics. Entries are counted from index size, while tombstones
+// are counted by one sequential read of index in big pages, during which links after
+// last checkpoint are validated as in Index.ValidateTail.
+func (i Index) Metrics() IndexMetrics {
+	var m IndexMetrics
+	info, err := i.Backend.Stat()
+	if err != nil {
+		m.Error = err.Error()
+		return m
+	}
+	m.Size = info.Size()
+	m.Entries, m.Valid = linksCount(m.Size)
+	if i.Checkpoints != nil {
+		if m.Checkpoints, _, err = i.checkpointsCount(); err != nil {
+			m.Error = err.Error()
+			return m
+		}
+	}
+
+	var (
+		c     = i.Cursor()
+		start = FileID(m.Checkpoints * CheckpointInterval)
+		empty = Link{}
+		id    FileID
+	)
+	for {
+		links, more := c.Next(metricsPageSize)
+		for _, l := range links {
+			if l.Offset < 0 {
+				m.Tombstones++
+			}
+			if id >= start && l != empty && l.ID != id {
+				m.Valid = false
+			}
+			id++
+		}
+		if !more {
+			break
+		}
+	}
+	if err := c.Err(); err != nil {
+		m.Valid = false
+		m.Error = err.Error()
+	}
+	return m
+}
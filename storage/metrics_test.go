@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestIndex_Metrics(t *testing.T) {
+	indexFile := tempFile(t)
+	defer clearTempFile(indexFile, t)
+	checkpointsFile := tempFile(t)
+	defer clearTempFile(checkpointsFile, t)
+	index := Index{Backend: indexFile, Checkpoints: checkpointsFile}
+
+	buf := NewLinkBuffer()
+	count := FileID(CheckpointInterval + 10)
+	for id := FileID(0); id < count; id++ {
+		l := Link{ID: id, Offset: Offset(id) * 100}
+		if id%10 == 0 {
+			l.Offset = -1
+		}
+		if err := index.WriteBuff(l, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	expected := IndexMetrics{
+		Entries:     int64(count),
+		Size:        IndexHeaderSize + int64(count)*LinkStructureSize,
+		Tombstones:  int64(count)/10 + 1,
+		Checkpoints: 1,
+		Valid:       true,
+	}
+	if m := index.Metrics(); m != expected {
+		t.Errorf("%+v != %+v", m, expected)
+	}
+
+	// corrupting tail
+	Link{ID: 5, Offset: 1}.Put(buf)
+	if _, err := indexFile.WriteAt(buf, int64(getLinkOffset(count-1))); err != nil {
+		t.Fatal(err)
+	}
+	if m := index.Metrics(); m.Valid {
+		t.Error("index with corrupted tail should not be valid")
+	}
+	if m := (Index{Backend: indexFile}).Metrics(); m.Valid || m.Checkpoints != 0 {
+		t.Errorf("unexpected metrics without checkpoints: %+v", m)
+	}
+}
@@ -0,0 +1,69 @@
+package storage
+
+// remapPageSize is count of links read at once from each index during remapping
+const remapPageSize = 4 * 1024
+
+// Remap is change of file offset in bulk after compaction
+type Remap struct {
+	ID        FileID
+	OldOffset Offset
+	NewOffset Offset
+}
+
+// RemapOffsetsFunc compares links of old and new index with same ID and calls fn
+// for every file which offset was changed, in order of ID. Files that are deleted
+// (not written, tombstoned or absent in new index) are skipped.
+// Indexes are read in pages, so memory usage does not depend on index size.
+// Iteration stops on first error returned by fn.
+// IDs are expected to be same in both indexes, so new index must not be
+// produced by Index.Compact, which renumbers links.
+func RemapOffsetsFunc(old, new Index, fn func(Remap) error) error {
+	var (
+		oldCursor = old.Cursor()
+		newCursor = new.Cursor()
+		empty     = Link{}
+		id        FileID
+	)
+	for {
+		oldLinks, oldMore := oldCursor.Next(remapPageSize)
+		newLinks, newMore := newCursor.Next(remapPageSize)
+		for j, o := range oldLinks {
+			if j >= len(newLinks) {
+				break
+			}
+			n := newLinks[j]
+			if o == empty || n == empty || o.Offset < 0 || n.Offset < 0 {
+				continue
+			}
+			if o.ID != id+FileID(j) || n.ID != o.ID {
+				return ErrIndexCorrupted
+			}
+			if o.Offset == n.Offset {
+				continue
+			}
+			if err := fn(Remap{ID: o.ID, OldOffset: o.Offset, NewOffset: n.Offset}); err != nil {
+				return err
+			}
+		}
+		id += FileID(len(oldLinks))
+		if !oldMore || !newMore {
+			break
+		}
+	}
+	if err := oldCursor.Err(); err != nil {
+		return err
+	}
+	return newCursor.Err()
+}
+
+// RemapOffsets returns map of old offset to new offset for every file which offset
+// was changed, see RemapOffsetsFunc. Whole mapping is held in memory, so
+// for huge indexes RemapOffsetsFunc should be used.
+func RemapOffsets(old, new Index) (map[Offset]Offset, error) {
+	offsets := make(map[Offset]Offset)
+	err := RemapOffsetsFunc(old, new, func(r Remap) error {
+		offsets[r.OldOffset] = r.NewOffset
+		return nil
+	})
+	return offsets, err
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRemapOffsets(t *testing.T) {
+	oldFile := tempFile(t)
+	defer clearTempFile(oldFile, t)
+	newFile := tempFile(t)
+	defer clearTempFile(newFile, t)
+	old := Index{Backend: oldFile}
+	new := Index{Backend: newFile}
+
+	buf := NewLinkBuffer()
+	count := FileID(remapPageSize + 100)
+	expected := make(map[Offset]Offset)
+	var newOffset Offset
+	for id := FileID(0); id < count; id++ {
+		if err := old.WriteBuff(Link{ID: id, Offset: Offset(id) * 100}, buf); err != nil {
+			t.Fatal(err)
+		}
+		l := Link{ID: id, Offset: newOffset}
+		switch {
+		case id%7 == 0:
+			// deleted during compaction
+			l.Offset = -1
+		case id < 10:
+			// not moved
+			l.Offset = Offset(id) * 100
+		default:
+			newOffset += 50
+			expected[Offset(id)*100] = l.Offset
+		}
+		if err := new.WriteBuff(l, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offsets, err := RemapOffsets(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offsets) != len(expected) {
+		t.Errorf("%d != %d", len(offsets), len(expected))
+	}
+	for o, n := range expected {
+		if offsets[o] != n {
+			t.Errorf("offset %d remapped to %d, expected %d", o, offsets[o], n)
+		}
+	}
+
+	// streaming is stopped on error
+	errStop := errors.New("stop")
+	calls := 0
+	err = RemapOffsetsFunc(old, new, func(r Remap) error {
+		calls++
+		if r.ID != FileID(r.OldOffset/100) {
+			t.Errorf("bad remap %+v", r)
+		}
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Errorf("unexpected %v after %d calls", err, calls)
+	}
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"io"
+	"sync"
+
+	"cydev.ru/hath"
+)
+
+// Store ties Index and bulk together, storing files with their info and linking them by ID.
+// Every file is appended to bulk as Header, serialized hath.File (see hath.File.Bytes)
+// and data, so Header.Size is hath.FileBytes + File.Size.
+//
+// Put is safe for concurrent use, as it is serialized by Store. Get is safe for concurrent
+// use with Get and Put if backends are, like MemoryBackend and *os.File.
+type Store struct {
+	Index *Index
+	Bulk  BulkBackend
+
+	mu     sync.Mutex
+	writer *BulkWriter
+}
+
+// NewStore opens index (see Index.Open) and returns Store that appends files to the end of bulk
+func NewStore(index *Index, bulk BulkBackend) (*Store, error) {
+	if err := index.Open(); err != nil {
+		return nil, err
+	}
+	writer, err := NewBulkWriter(bulk)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{Index: index, Bulk: bulk, writer: writer}, nil
+}
+
+// Put verifies that data is content of f (see hath.File.Verify), appends it to bulk
+// with next ID, that is current count of links in index, and links it in index.
+// Returns ID of stored file. On error nothing is linked, but appended part of file
+// takes space in bulk until vacuum.
+func (s *Store) Put(f hath.File, data []byte) (FileID, error) {
+	if err := f.Verify(data); err != nil {
+		return 0, err
+	}
+	info, err := f.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	record := make([]byte, 0, len(info)+len(data))
+	record = append(append(record, info...), data...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count, err := s.Index.Count()
+	if err != nil {
+		return 0, err
+	}
+	id := FileID(count)
+	l, err := s.writer.Append(id, record)
+	if err != nil {
+		return 0, err
+	}
+	if err = s.Index.Write(l); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Get returns file with provided id and its data. Returns hath.ErrFileNotFound if id is
+// out of index or is gap in it, ErrLinkDeleted if file was deleted, or
+// hath.ErrFileInconsistent if stored record is corrupted.
+func (s *Store) Get(id FileID) (hath.File, []byte, error) {
+	var f hath.File
+	buf := NewHeaderBuffer()
+	l, err := s.Index.ReadBuff(id, buf[:LinkStructureSize])
+	if err == io.EOF {
+		return f, nil, hath.ErrFileNotFound
+	}
+	if err != nil {
+		return f, nil, err
+	}
+	if l.ID != id {
+		// gaps are empty links
+		return f, nil, hath.ErrFileNotFound
+	}
+	h, err := Bulk{Backend: s.Bulk}.ReadHeader(l, buf)
+	if err != nil {
+		return f, nil, err
+	}
+	// size is read from bulk, so it is checked before allocation
+	if h.Size < hath.FileBytes || h.Size > hath.FileBytes+hath.FileMaximumSize {
+		return f, nil, hath.ErrFileInconsistent
+	}
+	record := make([]byte, h.Size)
+	n, err := s.Bulk.ReadAt(record, int64(h.DataOffset()))
+	if n < len(record) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return f, nil, err
+	}
+	if err = hath.FileFromBytesTo(record[:hath.FileBytes], &f); err != nil {
+		return f, nil, err
+	}
+	data := record[hath.FileBytes:]
+	if int64(len(data)) != f.Size {
+		return f, nil, hath.ErrFileInconsistent
+	}
+	return f, data, nil
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"sync"
+	"testing"
+
+	"cydev.ru/hath"
+)
+
+func newStoreFile(data []byte) hath.File {
+	return hath.File{
+		Hash:      sha1.Sum(data),
+		Type:      hath.JPG,
+		Size:      int64(len(data)),
+		Width:     100,
+		Height:    200,
+		LastUsage: 1445167700,
+	}
+}
+
+func TestStore(t *testing.T) {
+	index := &Index{Backend: &MemoryBackend{}}
+	bulk := &MemoryBackend{}
+	s, err := NewStore(index, bulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := [][]byte{
+		[]byte("first file"),
+		{},
+		bytes.Repeat([]byte{1, 2, 3}, 1000),
+	}
+	for i, blob := range blobs {
+		id, err := s.Put(newStoreFile(blob), blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != FileID(i) {
+			t.Errorf("id %d != %d", id, i)
+		}
+	}
+	for i, blob := range blobs {
+		f, data, err := s.Get(FileID(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := newStoreFile(blob); !f.Identical(expected) {
+			t.Errorf("%v != %v", f, expected)
+		}
+		if !bytes.Equal(data, blob) {
+			t.Errorf("data %d mismatch", i)
+		}
+	}
+
+	// data is verified before storing
+	bad := newStoreFile(blobs[0])
+	if _, err = s.Put(bad, []byte("other")); err != hath.ErrSizeMismatch {
+		t.Errorf("%v != %v", err, hath.ErrSizeMismatch)
+	}
+	if _, err = s.Put(bad, []byte("FIRST FILE")); err != hath.ErrHashMismatch {
+		t.Errorf("%v != %v", err, hath.ErrHashMismatch)
+	}
+	// file that can't be read back is not stored
+	large := make([]byte, hath.FileMaximumSize+1)
+	if _, err = s.Put(newStoreFile(large), large); err != hath.ErrSizeOverflow {
+		t.Errorf("%v != %v", err, hath.ErrSizeOverflow)
+	}
+
+	if _, _, err = s.Get(FileID(len(blobs))); err != hath.ErrFileNotFound {
+		t.Errorf("%v != %v", err, hath.ErrFileNotFound)
+	}
+	if err = index.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = s.Get(1); err != ErrLinkDeleted {
+		t.Errorf("%v != %v", err, ErrLinkDeleted)
+	}
+	// gap
+	if err = index.Write(Link{ID: 5, Offset: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = s.Get(4); err != hath.ErrFileNotFound {
+		t.Errorf("%v != %v", err, hath.ErrFileNotFound)
+	}
+	// corrupted size in header is rejected before allocation
+	l, err := index.ReadBuff(2, NewLinkBuffer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int64{-1, hath.FileBytes - 1, hath.FileBytes + hath.FileMaximumSize + 1, 1 << 62} {
+		buf := NewHeaderBuffer()
+		Header{ID: 2, Size: size, Offset: l.Offset}.Put(buf)
+		if _, err = bulk.WriteAt(buf, int64(l.Offset)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = s.Get(2); err != hath.ErrFileInconsistent {
+			t.Errorf("size %d: %v != %v", size, err, hath.ErrFileInconsistent)
+		}
+	}
+}
+
+func TestStore_Concurrent(t *testing.T) {
+	s, err := NewStore(&Index{Backend: &MemoryBackend{}}, &MemoryBackend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		ids = make(map[FileID][]byte)
+	)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				blob := []byte(fmt.Sprintf("file %d of %d", i, g))
+				id, err := s.Put(newStoreFile(blob), blob)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				ids[id] = blob
+				mu.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if len(ids) != 8*50 {
+		t.Fatalf("%d != %d", len(ids), 8*50)
+	}
+	for id, blob := range ids {
+		_, data, err := s.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, blob) {
+			t.Errorf("data %d mismatch", id)
+		}
+	}
+}
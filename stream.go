@@ -0,0 +1,62 @@
+package hath
+
+import (
+	"bufio"
+	"io"
+)
+
+// FileReader decodes stream of files serialized back-to-back with File.Bytes,
+// e.g. log of records, reading exactly FileBytes per file.
+// FileReader is not safe for concurrent use.
+type FileReader struct {
+	r   io.Reader
+	buf [FileBytes]byte
+}
+
+// NewFileReader returns FileReader that reads records from r
+func NewFileReader(r io.Reader) *FileReader {
+	return &FileReader{r: r}
+}
+
+// Next reads and decodes next file. Returns io.EOF if stream ended on record boundary,
+// or ErrFileInconsistent on partial trailing record or if record is corrupted.
+func (r *FileReader) Next() (File, error) {
+	var f File
+	_, err := io.ReadFull(r.r, r.buf[:])
+	if err == io.ErrUnexpectedEOF {
+		return f, ErrFileInconsistent
+	}
+	if err != nil {
+		return f, err
+	}
+	return f, FileFromBytesTo(r.buf[:], &f)
+}
+
+// FileWriter encodes files back-to-back with File.AppendBytes, so output
+// can be decoded by FileReader. Writes are buffered, and Flush must be called
+// after last file. FileWriter is not safe for concurrent use.
+type FileWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+// NewFileWriter returns FileWriter that writes records to w
+func NewFileWriter(w io.Writer) *FileWriter {
+	return &FileWriter{w: bufio.NewWriter(w), buf: make([]byte, 0, FileBytes)}
+}
+
+// Write appends serialized file to stream. Returns ErrSizeOverflow or
+// ErrLastUsageOverflow like File.Marshal, so records are never truncated.
+func (w *FileWriter) Write(f File) error {
+	if err := f.checkSerializable(); err != nil {
+		return err
+	}
+	w.buf = f.AppendBytes(w.buf[:0])
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+// Flush writes buffered records to underlying writer
+func (w *FileWriter) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,94 @@
+package hath
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileReader(t *testing.T) {
+	Convey("FileReader", t, func() {
+		g := defaultGenerator
+		var (
+			files = []File{g.NewFake(), g.NewFake(), g.NewFake()}
+			data  []byte
+		)
+		for _, f := range files {
+			data = append(data, f.Bytes()...)
+		}
+		Convey("Decode", func() {
+			// reading one byte at time to check that records are not split
+			r := NewFileReader(iotest.OneByteReader(bytes.NewReader(data)))
+			for _, expected := range files {
+				f, err := r.Next()
+				So(err, ShouldBeNil)
+				So(f.Identical(expected), ShouldBeTrue)
+			}
+			_, err := r.Next()
+			So(err, ShouldEqual, io.EOF)
+		})
+		Convey("Empty", func() {
+			_, err := NewFileReader(bytes.NewReader(nil)).Next()
+			So(err, ShouldEqual, io.EOF)
+		})
+		Convey("Partial record", func() {
+			r := NewFileReader(bytes.NewReader(data[:len(data)-1]))
+			for range files[:len(files)-1] {
+				_, err := r.Next()
+				So(err, ShouldBeNil)
+			}
+			_, err := r.Next()
+			So(err, ShouldEqual, ErrFileInconsistent)
+		})
+		Convey("Read error", func() {
+			_, err := NewFileReader(iotest.ErrReader(io.ErrClosedPipe)).Next()
+			So(err, ShouldEqual, io.ErrClosedPipe)
+		})
+	})
+}
+
+func TestFileWriter(t *testing.T) {
+	Convey("FileWriter", t, func() {
+		g := defaultGenerator
+		var (
+			files = make([]File, 1000)
+			out   bytes.Buffer
+			w     = NewFileWriter(&out)
+		)
+		for i := range files {
+			files[i] = g.NewFake()
+			So(w.Write(files[i]), ShouldBeNil)
+		}
+		So(w.Flush(), ShouldBeNil)
+		So(out.Len(), ShouldEqual, len(files)*FileBytes)
+		r := NewFileReader(&out)
+		for _, expected := range files {
+			f, err := r.Next()
+			So(err, ShouldBeNil)
+			So(f.Identical(expected), ShouldBeTrue)
+		}
+		_, err := r.Next()
+		So(err, ShouldEqual, io.EOF)
+		Convey("Overflow", func() {
+			So(w.Write(File{Size: -1}), ShouldEqual, ErrSizeOverflow)
+			So(w.Write(File{LastUsage: maxLastUsage + 1}), ShouldEqual, ErrLastUsageOverflow)
+			So(w.Flush(), ShouldBeNil)
+			So(out.Len(), ShouldEqual, 0)
+		})
+	})
+}
+
+func BenchmarkFileWriter(b *testing.B) {
+	f := defaultGenerator.NewFake()
+	w := NewFileWriter(io.Discard)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := w.Write(f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
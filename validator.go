@@ -0,0 +1,140 @@
+package hath
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrFileTooLarge is returned by SizeValidator if file exceeds maximum size
+	ErrFileTooLarge = errors.New("hath => file is too large")
+	// ErrFileTypeNotAllowed is returned by TypeValidator if file type is not in allowed list
+	ErrFileTypeNotAllowed = errors.New("hath => file type is not allowed")
+	// ErrFileTypeMismatch is returned by TypeValidator if data does not match file type
+	ErrFileTypeMismatch = errors.New("hath => file data does not match type")
+
+	// ErrHashMismatch is returned by ValidateContent and File.Verify if sha1 of data is
+	// not file hash. It is distinct from ErrFileInconsistent, that is returned for
+	// corrupted serialized records, so tampered content can be told apart from them.
+	ErrHashMismatch = errors.New("hath => file data does not match hash")
+	// ErrSizeMismatch is returned by ValidateContent and File.Verify if data length is not file size
+	ErrSizeMismatch = errors.New("hath => file data does not match size")
+)
+
+// ValidateContent reads r to the end, or until it exceeds file size, computing sha1 and length
+// of data in one pass without buffering. Returns ErrSizeMismatch or ErrHashMismatch if data
+// does not match file, or read error. To validate data that is written somewhere else,
+// r can be io.TeeReader.
+func ValidateContent(r io.Reader, f File) error {
+	hasher := sha1.New()
+	n, err := io.Copy(hasher, io.LimitReader(r, f.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != f.Size {
+		return ErrSizeMismatch
+	}
+	var hash [HashSize]byte
+	hasher.Sum(hash[:0])
+	if hash != f.Hash {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// Verify checks that data is content of file, returning ErrSizeMismatch
+// if data length is not file size or ErrHashMismatch if sha1 of data is not file hash.
+func (f File) Verify(data []byte) error {
+	if int64(len(data)) != f.Size {
+		return ErrSizeMismatch
+	}
+	hash := sha1.Sum(data)
+	if !bytes.Equal(hash[:], f.Hash[:]) {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// Validator checks file with its data before it is added to store
+type Validator interface {
+	Validate(f File, data []byte) error
+}
+
+// Validators is chain of validators that are run one by one in order
+// of the slice, stopping on first error, so cheap checks should go first.
+// Validators is Validator itself, so chains can be nested.
+type Validators []Validator
+
+// Validate runs all validators in order and returns first error
+func (v Validators) Validate(f File, data []byte) error {
+	for _, validator := range v {
+		if err := validator.Validate(f, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SizeValidator checks that data length equals file size and
+// does not exceed Max, which is FileMaximumSize if zero
+type SizeValidator struct {
+	Max int64
+}
+
+// Validate returns ErrSizeMismatch or ErrFileTooLarge
+func (v SizeValidator) Validate(f File, data []byte) error {
+	if int64(len(data)) != f.Size {
+		return ErrSizeMismatch
+	}
+	max := v.Max
+	if max == 0 {
+		max = FileMaximumSize
+	}
+	if f.Size > max {
+		return ErrFileTooLarge
+	}
+	return nil
+}
+
+// TypeValidator checks that file type is one of Types (any known type if empty)
+// and that data starts with magic bytes of that type
+type TypeValidator struct {
+	Types []FileType
+}
+
+// Validate returns ErrFileTypeNotAllowed or ErrFileTypeMismatch
+func (v TypeValidator) Validate(f File, data []byte) error {
+	if f.Type == UnknownImage {
+		return ErrFileTypeNotAllowed
+	}
+	if len(v.Types) > 0 {
+		allowed := false
+		for _, t := range v.Types {
+			if t == f.Type {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ErrFileTypeNotAllowed
+		}
+	}
+	if detectFileType(data) != f.Type {
+		return ErrFileTypeMismatch
+	}
+	return nil
+}
+
+// HashValidator checks that sha1 of data equals file hash
+type HashValidator struct{}
+
+// Validate returns ErrHashMismatch on hash mismatch
+func (HashValidator) Validate(f File, data []byte) error {
+	hash := sha1.Sum(data)
+	if !bytes.Equal(f.ByteID(), hash[:]) {
+		return ErrHashMismatch
+	}
+	return nil
+}
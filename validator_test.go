@@ -0,0 +1,103 @@
+package hath
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type validatorFunc func(f File, data []byte) error
+
+func (v validatorFunc) Validate(f File, data []byte) error {
+	return v(f, data)
+}
+
+func TestValidators(t *testing.T) {
+	Convey("Validators", t, func() {
+		data := append([]byte{0x89, 'P', 'N', 'G'}, make([]byte, 60)...)
+		f := File{Type: PNG, Size: int64(len(data))}
+		f.Hash = sha1.Sum(data)
+		chain := Validators{SizeValidator{}, TypeValidator{}, HashValidator{}}
+		So(chain.Validate(f, data), ShouldBeNil)
+		Convey("Size", func() {
+			So(SizeValidator{Max: 10}.Validate(f, data), ShouldEqual, ErrFileTooLarge)
+			So(SizeValidator{}.Validate(f, data[1:]), ShouldEqual, ErrSizeMismatch)
+		})
+		Convey("Type", func() {
+			So(TypeValidator{Types: []FileType{JPG, GIF}}.Validate(f, data), ShouldEqual, ErrFileTypeNotAllowed)
+			So(TypeValidator{Types: []FileType{JPG, PNG}}.Validate(f, data), ShouldBeNil)
+			f.Type = GIF
+			So(TypeValidator{}.Validate(f, data), ShouldEqual, ErrFileTypeMismatch)
+			f.Type = UnknownImage
+			So(TypeValidator{}.Validate(f, data), ShouldEqual, ErrFileTypeNotAllowed)
+		})
+		Convey("Hash", func() {
+			f.Hash[0]++
+			So(HashValidator{}.Validate(f, data), ShouldEqual, ErrHashMismatch)
+		})
+		Convey("Order", func() {
+			var calls []int
+			errStop := errors.New("stop")
+			chain := Validators{
+				validatorFunc(func(File, []byte) error { calls = append(calls, 1); return nil }),
+				validatorFunc(func(File, []byte) error { calls = append(calls, 2); return errStop }),
+				validatorFunc(func(File, []byte) error { calls = append(calls, 3); return nil }),
+			}
+			So(chain.Validate(f, data), ShouldEqual, errStop)
+			So(calls, ShouldResemble, []int{1, 2})
+		})
+		Convey("MemStore", func() {
+			m := &MemStore{Validators: chain}
+			So(m.Add(f, bytes.NewReader(data)), ShouldBeNil)
+			bad := f
+			bad.Hash[0]++
+			So(m.Add(bad, bytes.NewReader(data)), ShouldEqual, ErrHashMismatch)
+			So(m.Size(), ShouldEqual, f.Size)
+		})
+	})
+}
+
+func TestFileVerify(t *testing.T) {
+	Convey("Verify", t, func() {
+		data := []byte("some image data")
+		f := File{Type: PNG, Size: int64(len(data)), Hash: sha1.Sum(data)}
+		So(f.Verify(data), ShouldBeNil)
+		Convey("Tampered", func() {
+			tampered := append([]byte(nil), data...)
+			tampered[3] ^= 1
+			So(f.Verify(tampered), ShouldEqual, ErrHashMismatch)
+		})
+		Convey("Length", func() {
+			So(f.Verify(data[1:]), ShouldEqual, ErrSizeMismatch)
+			So(f.Verify(append(data, 'x')), ShouldEqual, ErrSizeMismatch)
+			So(f.Verify(nil), ShouldEqual, ErrSizeMismatch)
+		})
+	})
+}
+
+func TestValidateContent(t *testing.T) {
+	Convey("Validate content", t, func() {
+		data := []byte("some image data")
+		f := File{Type: PNG, Size: int64(len(data)), Hash: sha1.Sum(data)}
+		So(ValidateContent(bytes.NewReader(data), f), ShouldBeNil)
+		So(ValidateContent(bytes.NewReader(data[1:]), f), ShouldEqual, ErrSizeMismatch)
+		So(ValidateContent(bytes.NewReader(append(data, 'x')), f), ShouldEqual, ErrSizeMismatch)
+		bad := f
+		bad.Hash[0]++
+		So(ValidateContent(bytes.NewReader(data), bad), ShouldEqual, ErrHashMismatch)
+		So(errors.Is(ErrHashMismatch, ErrFileInconsistent), ShouldBeFalse)
+		So(errors.Is(ErrSizeMismatch, ErrFileBadLength), ShouldBeFalse)
+		_, err := FileFromBytes(make([]byte, FileBytes-1))
+		So(errors.Is(err, ErrHashMismatch), ShouldBeFalse)
+		Convey("Read error", func() {
+			errRead := errors.New("read failed")
+			r := io.MultiReader(bytes.NewReader(data[:5]), iotest.ErrReader(errRead))
+			So(ValidateContent(r, f), ShouldEqual, errRead)
+		})
+	})
+}